@@ -0,0 +1,588 @@
+package bhfs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+type ArchiveFormat int
+
+const (
+	Tar ArchiveFormat = iota
+	TarGzip
+	TarZstd
+	Zip
+)
+
+var (
+	ErrUnsafePath   = errors.New("unsafe path in archive")
+	ErrArchiveLimit = errors.New("archive limit exceeded")
+)
+
+// ArchiveFormatFromName guesses the format from the file extension.
+func ArchiveFormatFromName(name string) (ArchiveFormat, bool) {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return TarGzip, true
+	case strings.HasSuffix(name, ".tar.zst"), strings.HasSuffix(name, ".tzst"):
+		return TarZstd, true
+	case strings.HasSuffix(name, ".tar"):
+		return Tar, true
+	case strings.HasSuffix(name, ".zip"):
+		return Zip, true
+	default:
+		return 0, false
+	}
+}
+
+// ExtractLimits bounds what an archive may unpack. Zero means unlimited.
+type ExtractLimits struct {
+	MaxEntries   int
+	MaxFileSize  int64
+	MaxTotalSize int64
+}
+
+// CreateArchive writes the tree under root to w. Entry names are relative
+// to root and symlinks are stored as links.
+func CreateArchive(w io.Writer, root string, format ArchiveFormat) error {
+	switch format {
+	case Tar:
+		return writeTar(w, root)
+	case TarGzip:
+		zw := gzip.NewWriter(w)
+		if err := writeTar(zw, root); err != nil {
+			zw.Close()
+			return err
+		}
+		return zw.Close()
+	case TarZstd:
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			return err
+		}
+		if err := writeTar(zw, root); err != nil {
+			zw.Close()
+			return err
+		}
+		return zw.Close()
+	case Zip:
+		return writeZip(w, root)
+	default:
+		return fmt.Errorf("unknown archive format %d", format)
+	}
+}
+
+// ExtractArchive unpacks r into dst. Entries escaping dst, absolute or
+// escaping symlinks and entries below a symlink are rejected with
+// ErrUnsafePath. Symlinks are created after all other entries. Zip input that is not an io.ReaderAt is spooled to a
+// temporary file first.
+func ExtractArchive(r io.Reader, dst string, format ArchiveFormat, limits ExtractLimits) error {
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+
+	x := &extractor{dst: dst, limits: limits}
+	switch format {
+	case Tar:
+		return x.tar(r)
+	case TarGzip:
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		return x.tar(zr)
+	case TarZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		return x.tar(zr)
+	case Zip:
+		return x.zip(r)
+	default:
+		return fmt.Errorf("unknown archive format %d", format)
+	}
+}
+
+func walkArchive(root string, f func(name, path string, info fs.FileInfo) error) error {
+	return filepath.Walk(root, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+
+		return f(filepath.ToSlash(rel), path, info)
+	})
+}
+
+func writeTar(w io.Writer, root string) error {
+	tw := tar.NewWriter(w)
+	err := walkArchive(root, func(name, path string, info fs.FileInfo) error {
+		var link string
+		if info.Mode()&fs.ModeSymlink != 0 {
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			link = target
+		}
+
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		return copyFileTo(tw, path)
+	})
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+func writeZip(w io.Writer, root string) error {
+	zw := zip.NewWriter(w)
+	err := walkArchive(root, func(name, path string, info fs.FileInfo) error {
+		hdr, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+		if info.IsDir() {
+			hdr.Name += "/"
+		} else {
+			hdr.Method = zip.Deflate
+		}
+
+		fw, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case info.Mode()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			_, err = io.WriteString(fw, target)
+			return err
+		case info.Mode().IsRegular():
+			return copyFileTo(fw, path)
+		default:
+			return nil
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+func copyFileTo(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+type extractor struct {
+	dst     string
+	limits  ExtractLimits
+	entries int
+	total   int64
+	links   []archiveLink
+}
+
+// archiveLink is a symlink entry, created after every other entry.
+type archiveLink struct {
+	name, target string
+}
+
+func (x *extractor) tar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return x.symlinks()
+		}
+		if err != nil {
+			return err
+		}
+
+		mode := hdr.FileInfo().Mode()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = x.dir(hdr.Name, mode)
+		case tar.TypeReg:
+			err = x.file(hdr.Name, mode, tr)
+		case tar.TypeSymlink:
+			err = x.symlink(hdr.Name, hdr.Linkname)
+		case tar.TypeLink:
+			err = x.hardlink(hdr.Name, hdr.Linkname)
+		default:
+			// devices, fifos and extended headers are skipped
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (x *extractor) zip(r io.Reader) error {
+	ra, size, cleanup, err := readerAt(r)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	zr, err := zip.NewReader(ra, size)
+	if err != nil {
+		return err
+	}
+
+	for _, zf := range zr.File {
+		if err := x.zipEntry(zf); err != nil {
+			return err
+		}
+	}
+	return x.symlinks()
+}
+
+func (x *extractor) zipEntry(zf *zip.File) error {
+	mode := zf.Mode()
+	switch {
+	case mode.IsDir():
+		return x.dir(zf.Name, mode)
+	case mode&fs.ModeSymlink != 0:
+		rc, err := zf.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+
+		target, err := io.ReadAll(io.LimitReader(rc, 4096))
+		if err != nil {
+			return err
+		}
+		return x.symlink(zf.Name, string(target))
+	case mode.IsRegular():
+		rc, err := zf.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		return x.file(zf.Name, mode, rc)
+	default:
+		return nil
+	}
+}
+
+func readerAt(r io.Reader) (io.ReaderAt, int64, func(), error) {
+	switch v := r.(type) {
+	case *os.File:
+		info, err := v.Stat()
+		off, serr := v.Seek(0, io.SeekCurrent)
+		if err == nil && serr == nil && info.Mode().IsRegular() {
+			return io.NewSectionReader(v, off, info.Size()-off), info.Size() - off, func() {}, nil
+		}
+	case interface {
+		io.ReaderAt
+		Size() int64
+	}:
+		return v, v.Size(), func() {}, nil
+	}
+
+	f, err := os.CreateTemp("", "bhfs-zip-*")
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	cleanup := func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+
+	size, err := io.Copy(f, r)
+	if err != nil {
+		cleanup()
+		return nil, 0, nil, err
+	}
+	return f, size, cleanup, nil
+}
+
+// target validates an entry name and returns its destination path.
+func (x *extractor) target(name string) (string, error) {
+	if x.limits.MaxEntries > 0 && x.entries >= x.limits.MaxEntries {
+		return "", fmt.Errorf("%w: more than %d entries", ErrArchiveLimit, x.limits.MaxEntries)
+	}
+	x.entries++
+
+	rel := filepath.FromSlash(strings.TrimSuffix(name, "/"))
+	if !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("%w: %s", ErrUnsafePath, name)
+	}
+
+	// refuse to write through a symlink, whether it came from the
+	// archive or was already present in dst
+	if err := x.checkParents(name); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(x.dst, rel)
+	if info, err := os.Lstat(path); err == nil && !info.IsDir() {
+		if err := os.Remove(path); err != nil {
+			return "", err
+		}
+	}
+	return path, nil
+}
+
+// checkParents walks the slash separated name before it is cleaned and
+// fails if any existing parent on the way is a symlink.
+func (x *extractor) checkParents(name string) error {
+	parts := strings.Split(name, "/")
+	dir := x.dst
+	for _, part := range parts[:len(parts)-1] {
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			dir = filepath.Dir(dir)
+			continue
+		}
+
+		dir = filepath.Join(dir, part)
+		info, err := os.Lstat(dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("%w: %s is below a symlink", ErrUnsafePath, name)
+		}
+	}
+	return nil
+}
+
+func (x *extractor) dir(name string, mode fs.FileMode) error {
+	path, err := x.target(name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(path, mode.Perm()|0700)
+}
+
+func (x *extractor) file(name string, mode fs.FileMode, r io.Reader) error {
+	path, err := x.target(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	limit := int64(-1)
+	if x.limits.MaxFileSize > 0 {
+		limit = x.limits.MaxFileSize
+	}
+	if x.limits.MaxTotalSize > 0 && (limit < 0 || x.limits.MaxTotalSize-x.total < limit) {
+		limit = x.limits.MaxTotalSize - x.total
+	}
+	if limit >= 0 {
+		// read one byte more than allowed to detect oversized entries,
+		// header sizes are not trusted
+		r = io.LimitReader(r, limit+1)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return err
+	}
+
+	n, err := io.Copy(f, r)
+	x.total += n
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if limit >= 0 && n > limit {
+		os.Remove(path)
+		return fmt.Errorf("%w: %s is too large", ErrArchiveLimit, name)
+	}
+	return nil
+}
+
+// symlink checks the link target lexically and defers the link, so that
+// no entry is written through a symlink from the archive.
+func (x *extractor) symlink(name, linkname string) error {
+	if filepath.IsAbs(linkname) || strings.HasPrefix(linkname, "/") {
+		return fmt.Errorf("%w: %s links to absolute path %s", ErrUnsafePath, name, linkname)
+	}
+
+	rel := filepath.Join(filepath.Dir(filepath.FromSlash(name)), filepath.FromSlash(linkname))
+	if !filepath.IsLocal(rel) {
+		return fmt.Errorf("%w: %s links outside the archive", ErrUnsafePath, name)
+	}
+
+	x.links = append(x.links, archiveLink{name, linkname})
+	return nil
+}
+
+// symlinks creates the deferred links. The lexical check of a target is
+// not enough once links point through each other, so every link is
+// resolved again when all of them exist.
+func (x *extractor) symlinks() error {
+	created := make([]string, 0, len(x.links))
+	for _, l := range x.links {
+		path, err := x.target(l.name)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := os.Symlink(l.target, path); err != nil {
+			return err
+		}
+		created = append(created, path)
+	}
+
+	for i, path := range created {
+		if err := x.checkResolved(x.links[i].name); err != nil {
+			os.Remove(path)
+			return err
+		}
+	}
+	return nil
+}
+
+// checkResolved follows name below dst like the kernel does and fails if it
+// ends up outside dst. Missing components are resolved lexically.
+func (x *extractor) checkResolved(name string) error {
+	root, err := filepath.Abs(x.dst)
+	if err != nil {
+		return err
+	}
+	if root, err = filepath.EvalSymlinks(root); err != nil {
+		return err
+	}
+
+	cur := root
+	parts := strings.Split(filepath.ToSlash(name), "/")
+	for links := 0; len(parts) > 0; {
+		part := parts[0]
+		parts = parts[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			cur = filepath.Dir(cur)
+			continue
+		}
+
+		next := filepath.Join(cur, part)
+		info, err := os.Lstat(next)
+		if errors.Is(err, fs.ErrNotExist) {
+			cur = next
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&fs.ModeSymlink == 0 {
+			cur = next
+			continue
+		}
+
+		if links++; links > 40 {
+			return &fs.PathError{Op: "extract", Path: name, Err: errors.New("too many levels of symbolic links")}
+		}
+		target, err := os.Readlink(next)
+		if err != nil {
+			return err
+		}
+		if filepath.IsAbs(target) {
+			cur = string(filepath.Separator)
+		}
+		parts = append(strings.Split(filepath.ToSlash(target), "/"), parts...)
+	}
+
+	if cur != root && !strings.HasPrefix(cur, root+string(filepath.Separator)) {
+		return fmt.Errorf("%w: %s resolves outside the archive", ErrUnsafePath, name)
+	}
+	return nil
+}
+
+func (x *extractor) hardlink(name, linkname string) error {
+	rel := filepath.FromSlash(linkname)
+	if !filepath.IsLocal(rel) {
+		return fmt.Errorf("%w: %s links outside the archive", ErrUnsafePath, name)
+	}
+
+	if err := x.checkParents(linkname); err != nil {
+		return err
+	}
+	if err := x.checkResolved(linkname); err != nil {
+		return err
+	}
+
+	old := filepath.Join(x.dst, rel)
+	info, err := os.Lstat(old)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%w: %s links to a non-regular file", ErrUnsafePath, name)
+	}
+
+	path, err := x.target(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.Link(old, path)
+}
@@ -0,0 +1,197 @@
+package bhfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"iter"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	blobTmpDir    = "tmp"
+	blobTmpMaxAge = time.Hour
+)
+
+var ErrInvalidDigest = errors.New("invalid blob digest")
+
+// BlobStore keeps blobs addressed by the hex SHA-256 of their content in
+// dir/ab/cd/abcd..., so identical content is stored once.
+type BlobStore struct {
+	dir string
+}
+
+// GCStats summarizes a BlobStore.GC run.
+type GCStats struct {
+	Removed int
+	Freed   int64
+}
+
+func NewBlobStore(dir string) (*BlobStore, error) {
+	if err := os.MkdirAll(filepath.Join(dir, blobTmpDir), 0755); err != nil {
+		return nil, err
+	}
+	return &BlobStore{dir: dir}, nil
+}
+
+// Put streams r into the store and returns its digest and size. The blob
+// becomes visible atomically once it is complete.
+func (bs *BlobStore) Put(r io.Reader) (string, int64, error) {
+	tmp, err := os.CreateTemp(filepath.Join(bs.dir, blobTmpDir), "put-*")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", 0, err
+	}
+
+	digest := hex.EncodeToString(h.Sum(nil))
+	path, _ := bs.Path(digest)
+	if _, err := os.Stat(path); err == nil {
+		return digest, n, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", 0, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", 0, err
+	}
+	return digest, n, nil
+}
+
+// Path returns where the blob with digest is stored.
+func (bs *BlobStore) Path(digest string) (string, error) {
+	if !validDigest(digest) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidDigest, digest)
+	}
+	return filepath.Join(bs.dir, digest[0:2], digest[2:4], digest), nil
+}
+
+func (bs *BlobStore) Get(digest string) (*os.File, error) {
+	path, err := bs.Path(digest)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+func (bs *BlobStore) Has(digest string) (bool, error) {
+	path, err := bs.Path(digest)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (bs *BlobStore) Delete(digest string) error {
+	path, err := bs.Path(digest)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// List yields the digest of every stored blob.
+func (bs *BlobStore) List() iter.Seq2[string, error] {
+	return func(yield func(string, error) bool) {
+		err := filepath.WalkDir(bs.dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if !yield("", err) {
+					return filepath.SkipAll
+				}
+				return nil
+			}
+
+			rel, _ := filepath.Rel(bs.dir, path)
+			if d.IsDir() {
+				if rel == blobTmpDir {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			if strings.Count(rel, string(filepath.Separator)) != 2 || !validDigest(d.Name()) {
+				return nil
+			}
+			if !yield(d.Name(), nil) {
+				return filepath.SkipAll
+			}
+			return nil
+		})
+		if err != nil {
+			yield("", err)
+		}
+	}
+}
+
+// GC deletes every blob for which live returns false, together with
+// leftovers of interrupted Puts.
+func (bs *BlobStore) GC(live func(digest string) bool) (GCStats, error) {
+	var stats GCStats
+	for digest, err := range bs.List() {
+		if err != nil {
+			return stats, err
+		}
+		if live(digest) {
+			continue
+		}
+
+		path, _ := bs.Path(digest)
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return stats, err
+		}
+		stats.Removed++
+		stats.Freed += info.Size()
+	}
+
+	entries, err := os.ReadDir(filepath.Join(bs.dir, blobTmpDir))
+	if err != nil {
+		return stats, err
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || time.Since(info.ModTime()) < blobTmpMaxAge {
+			continue
+		}
+		os.Remove(filepath.Join(bs.dir, blobTmpDir, e.Name()))
+	}
+	return stats, nil
+}
+
+func validDigest(digest string) bool {
+	if len(digest) != sha256.Size*2 {
+		return false
+	}
+	for _, c := range digest {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
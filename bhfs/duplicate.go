@@ -0,0 +1,303 @@
+package bhfs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// ErrDuplicateChanged is returned by ReplaceDuplicates for a file whose size
+// or content differs from its DuplicateGroup.
+var ErrDuplicateChanged = errors.New("file changed since duplicates were found")
+
+type DuplicateOptions struct {
+	// Concurrency limits how many files are hashed at the same time.
+	// Defaults to runtime.NumCPU().
+	Concurrency int
+	// MinSize skips smaller files. Empty files are always skipped.
+	MinSize int64
+	// PartialSize is the number of leading bytes hashed before a file
+	// is hashed in full. Defaults to 4KiB.
+	PartialSize int64
+}
+
+// DuplicateGroup is a set of files with identical content.
+// Paths that are already hard links of each other are reported once.
+type DuplicateGroup struct {
+	Size  int64
+	Hash  string
+	Files []string
+}
+
+type LinkMode int
+
+const (
+	Hardlink LinkMode = iota
+	Reflink
+)
+
+type dupFile struct {
+	path string
+	info fs.FileInfo
+}
+
+// FindDuplicates walks dirs and groups regular files by size, then by the hash
+// of their first PartialSize bytes and finally by the SHA-256 of the whole file.
+func FindDuplicates(ctx context.Context, dirs []string, opts DuplicateOptions) ([]DuplicateGroup, error) {
+	if opts.Concurrency < 1 {
+		opts.Concurrency = runtime.NumCPU()
+	}
+	if opts.MinSize < 1 {
+		opts.MinSize = 1
+	}
+	if opts.PartialSize < 1 {
+		opts.PartialSize = 4 * 1024
+	}
+
+	bySize := map[int64][]dupFile{}
+	for _, dir := range dirs {
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if info.Size() < opts.MinSize {
+				return nil
+			}
+
+			for _, f := range bySize[info.Size()] {
+				if os.SameFile(f.info, info) {
+					return nil
+				}
+			}
+			bySize[info.Size()] = append(bySize[info.Size()], dupFile{path, info})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var candidates []dupFile
+	for _, files := range bySize {
+		if len(files) > 1 {
+			candidates = append(candidates, files...)
+		}
+	}
+
+	partial, err := bucketByHash(ctx, candidates, opts.Concurrency, opts.PartialSize)
+	if err != nil {
+		return nil, err
+	}
+
+	// files no longer than PartialSize were already hashed in full
+	candidates = candidates[:0]
+	for key, files := range partial {
+		if len(files) > 1 && key.size > opts.PartialSize {
+			candidates = append(candidates, files...)
+		}
+	}
+
+	full, err := bucketByHash(ctx, candidates, opts.Concurrency, -1)
+	if err != nil {
+		return nil, err
+	}
+	for key, files := range partial {
+		if key.size <= opts.PartialSize {
+			full[key] = files
+		}
+	}
+
+	var groups []DuplicateGroup
+	for key, files := range full {
+		if len(files) < 2 {
+			continue
+		}
+
+		paths := make([]string, len(files))
+		for i, f := range files {
+			paths[i] = f.path
+		}
+		sort.Strings(paths)
+
+		groups = append(groups, DuplicateGroup{
+			Size:  key.size,
+			Hash:  key.hash,
+			Files: paths,
+		})
+	}
+
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Files[0] < groups[j].Files[0]
+	})
+	return groups, nil
+}
+
+type hashKey struct {
+	size int64
+	hash string
+}
+
+// bucketByHash hashes the first limit bytes of every file, or the whole file
+// when limit is negative.
+func bucketByHash(ctx context.Context, files []dupFile, concurrency int, limit int64) (map[hashKey][]dupFile, error) {
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+		sem      = make(chan struct{}, concurrency)
+		buckets  = map[hashKey][]dupFile{}
+	)
+
+	for _, f := range files {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return nil, ctx.Err()
+		}
+
+		wg.Add(1)
+		go func(f dupFile) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			hash, err := hashFile(f.path, limit)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+
+			key := hashKey{f.info.Size(), hash}
+			buckets[key] = append(buckets[key], f)
+		}(f)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return buckets, nil
+}
+
+func hashFile(path string, limit int64) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if limit >= 0 {
+		r = io.LimitReader(f, limit)
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ReplaceDuplicates replaces every file of group except the first with a link
+// to the first one. Each file is hashed again and swapped in atomically
+// through a rename, so a file modified since FindDuplicates is kept.
+func ReplaceDuplicates(group DuplicateGroup, mode LinkMode) error {
+	if len(group.Files) < 2 {
+		return nil
+	}
+	if mode != Hardlink && mode != Reflink {
+		return fs.ErrInvalid
+	}
+
+	src := group.Files[0]
+	srcInfo, err := checkDuplicate(src, group)
+	if err != nil {
+		return err
+	}
+
+	for _, dst := range group.Files[1:] {
+		info, err := checkDuplicate(dst, group)
+		if err != nil {
+			return err
+		}
+		if os.SameFile(srcInfo, info) {
+			continue
+		}
+
+		tmp, err := linkTemp(src, dst, mode)
+		if err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, dst); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	return nil
+}
+
+// checkDuplicate makes sure path still has the size and hash of group.
+func checkDuplicate(path string, group DuplicateGroup) (fs.FileInfo, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() || info.Size() != group.Size {
+		return nil, &fs.PathError{Op: "dedup", Path: path, Err: ErrDuplicateChanged}
+	}
+
+	hash, err := hashFile(path, -1)
+	if err != nil {
+		return nil, err
+	}
+	if hash != group.Hash {
+		return nil, &fs.PathError{Op: "dedup", Path: path, Err: ErrDuplicateChanged}
+	}
+	return info, nil
+}
+
+// linkTemp links src to a new randomly named file next to dst, so that a
+// leftover of an interrupted run does not get in the way.
+func linkTemp(src, dst string, mode LinkMode) (string, error) {
+	for i := 0; ; i++ {
+		tmp := filepath.Join(filepath.Dir(dst), fmt.Sprintf(".%s.%d.dedup", filepath.Base(dst), rand.Uint32()))
+
+		var err error
+		if mode == Hardlink {
+			err = os.Link(src, tmp)
+		} else {
+			err = reflinkFile(src, tmp)
+		}
+		if err == nil || !errors.Is(err, fs.ErrExist) || i == 100 {
+			return tmp, err
+		}
+	}
+}
@@ -0,0 +1,40 @@
+//go:build linux
+
+package bhfs
+
+import (
+	"os"
+	"syscall"
+)
+
+// FICLONE from linux/fs.h
+const ficlone = 0x40049409
+
+func reflinkFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, out.Fd(), ficlone, in.Fd())
+	if cerr := out.Close(); errno == 0 && cerr != nil {
+		os.Remove(dst)
+		return cerr
+	}
+	if errno != 0 {
+		os.Remove(dst)
+		return &os.LinkError{Op: "reflink", Old: src, New: dst, Err: errno}
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package bhfs
+
+import (
+	"errors"
+	"os"
+)
+
+func reflinkFile(src, dst string) error {
+	return &os.LinkError{Op: "reflink", Old: src, New: dst, Err: errors.ErrUnsupported}
+}
@@ -0,0 +1,198 @@
+package bhfs
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/emirpasic/gods/v2/maps/treemap"
+)
+
+const lockRetryInterval = 10 * time.Millisecond
+
+// FileLock is an advisory lock on a file shared between processes.
+// Within one process every FileLock holds its own descriptor, so two
+// FileLocks on the same path exclude each other as well.
+type FileLock struct {
+	path string
+	mu   sync.Mutex
+	f    *os.File
+}
+
+// NewFileLock creates a lock on path. The file is created on first lock.
+func NewFileLock(path string) *FileLock {
+	return &FileLock{path: path}
+}
+
+func (l *FileLock) Path() string {
+	return l.path
+}
+
+// Lock acquires an exclusive lock, waiting until ctx is done.
+func (l *FileLock) Lock(ctx context.Context) error {
+	return l.lock(ctx, true)
+}
+
+// RLock acquires a shared lock, waiting until ctx is done.
+func (l *FileLock) RLock(ctx context.Context) error {
+	return l.lock(ctx, false)
+}
+
+// TryLock acquires an exclusive lock without waiting.
+func (l *FileLock) TryLock() (bool, error) {
+	return l.tryLock(true)
+}
+
+// TryRLock acquires a shared lock without waiting.
+func (l *FileLock) TryRLock() (bool, error) {
+	return l.tryLock(false)
+}
+
+// Unlock releases the lock, shared or exclusive.
+func (l *FileLock) Unlock() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return errors.New("file lock is not held")
+	}
+
+	err := unlockFile(l.f)
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	l.f = nil
+	return err
+}
+
+func (l *FileLock) lock(ctx context.Context, exclusive bool) error {
+	for {
+		ok, err := l.tryLock(exclusive)
+		if err != nil || ok {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(lockRetryInterval):
+		}
+	}
+}
+
+func (l *FileLock) tryLock(exclusive bool) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f != nil {
+		return false, errors.New("file lock is already held")
+	}
+
+	f, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return false, err
+	}
+
+	ok, err := tryLockFile(f, exclusive)
+	if err != nil || !ok {
+		f.Close()
+		return false, err
+	}
+
+	l.f = f
+	return true, nil
+}
+
+// MapFileMutex is the cross-process counterpart of bhsync.MapRWMutex:
+// every key is backed by a lock file in dir.
+type MapFileMutex[T cmp.Ordered] struct {
+	dir string
+	mut sync.Mutex
+	m   *treemap.Map[T, []*FileLock]
+}
+
+func NewMapFileMutex[T cmp.Ordered](dir string) *MapFileMutex[T] {
+	return &MapFileMutex[T]{
+		dir: dir,
+		mut: sync.Mutex{},
+		m:   treemap.New[T, []*FileLock](),
+	}
+}
+
+func (m *MapFileMutex[T]) Lock(ctx context.Context, k T) error {
+	_, err := m.tryAcquire(k, func(l *FileLock) (bool, error) {
+		err := l.Lock(ctx)
+		return err == nil, err
+	})
+	return err
+}
+
+func (m *MapFileMutex[T]) RLock(ctx context.Context, k T) error {
+	_, err := m.tryAcquire(k, func(l *FileLock) (bool, error) {
+		err := l.RLock(ctx)
+		return err == nil, err
+	})
+	return err
+}
+
+func (m *MapFileMutex[T]) TryLock(k T) (bool, error) {
+	return m.tryAcquire(k, (*FileLock).TryLock)
+}
+
+func (m *MapFileMutex[T]) TryRLock(k T) (bool, error) {
+	return m.tryAcquire(k, (*FileLock).TryRLock)
+}
+
+func (m *MapFileMutex[T]) Unlock(k T) error {
+	return m.release(k)
+}
+
+func (m *MapFileMutex[T]) RUnlock(k T) error {
+	return m.release(k)
+}
+
+// IsLocked reports whether k is held by this process.
+func (m *MapFileMutex[T]) IsLocked(k T) bool {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	_, ok := m.m.Get(k)
+	return ok
+}
+
+func (m *MapFileMutex[T]) tryAcquire(k T, lock func(*FileLock) (bool, error)) (bool, error) {
+	l := NewFileLock(filepath.Join(m.dir, fmt.Sprint(k)+".lock"))
+	ok, err := lock(l)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	m.mut.Lock()
+	v, _ := m.m.Get(k)
+	m.m.Put(k, append(v, l))
+	m.mut.Unlock()
+	return true, nil
+}
+
+func (m *MapFileMutex[T]) release(k T) error {
+	m.mut.Lock()
+	v, ok := m.m.Get(k)
+	if !ok {
+		m.mut.Unlock()
+		return errors.New("file lock is not held")
+	}
+
+	l := v[len(v)-1]
+	if len(v) == 1 {
+		m.m.Remove(k)
+	} else {
+		m.m.Put(k, v[:len(v)-1])
+	}
+	m.mut.Unlock()
+
+	return l.Unlock()
+}
@@ -7,6 +7,8 @@ import (
 	"path/filepath"
 )
 
+// FileIsExisted reports false only if filename is known not to exist.
+// Use Stat to tell other stat errors apart.
 func FileIsExisted(filename string) bool {
 	var exist = true
 	if _, err := os.Stat(filename); os.IsNotExist(err) {
@@ -45,6 +47,7 @@ func MV(src, dst string) error {
 	return nil
 }
 
+// IsDir reports false on any stat error. Use Stat to tell them apart.
 func IsDir(s string) bool {
 	stat, err := os.Stat(s)
 	if err != nil {
@@ -0,0 +1,83 @@
+package bhfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var ErrProcessRunning = errors.New("process is already running")
+
+// PIDFile records the pid of the current process and holds an exclusive
+// lock on the file for as long as it is open.
+type PIDFile struct {
+	lock *FileLock
+}
+
+// CreatePIDFile writes the current pid to path. The owner holds a lock on
+// the file until it exits, so an unlocked pid file is stale and taken over,
+// even if its pid was reused by another process. Otherwise
+// ErrProcessRunning is returned.
+func CreatePIDFile(path string) (*PIDFile, error) {
+	lock := NewFileLock(path)
+	ok, err := lock.TryLock()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		pid, _ := ReadPIDFile(path)
+		return nil, fmt.Errorf("%w: pid %d", ErrProcessRunning, pid)
+	}
+
+	if err := os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+
+	return &PIDFile{lock: lock}, nil
+}
+
+func (pf *PIDFile) Path() string {
+	return pf.lock.Path()
+}
+
+// Remove deletes the pid file and releases its lock.
+func (pf *PIDFile) Remove() error {
+	err := os.Remove(pf.lock.Path())
+	if uerr := pf.lock.Unlock(); err == nil {
+		err = uerr
+	}
+	return err
+}
+
+func ReadPIDFile(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("invalid pid file %s", path)
+	}
+	return pid, nil
+}
+
+// ProcessAlive reports whether a process with pid exists.
+func ProcessAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	return processAlive(pid)
+}
+
+// IsStalePIDFile reports whether path names a process that is no longer alive.
+func IsStalePIDFile(path string) (bool, error) {
+	pid, err := ReadPIDFile(path)
+	if err != nil {
+		return false, err
+	}
+	return !ProcessAlive(pid), nil
+}
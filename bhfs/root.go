@@ -0,0 +1,264 @@
+package bhfs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var ErrPathEscape = errors.New("path escapes root")
+
+const maxSymlinks = 40
+
+// SafeJoin joins name onto root like filepath.Join, but fails with
+// ErrPathEscape if the result, after resolving symlinks below root,
+// would lie outside of root.
+func SafeJoin(root, name string) (string, error) {
+	if filepath.IsAbs(name) {
+		return "", &fs.PathError{Op: "join", Path: name, Err: ErrPathEscape}
+	}
+	return resolveIn(root, "join", filepath.ToSlash(name), true)
+}
+
+// Root gives access to the tree below a directory. Names are slash
+// separated and relative to the root; `..` and symlinks are followed only
+// as long as they stay inside of it. Checks are done before each
+// operation, so a concurrent rename outside of Root's control can still
+// race with them.
+type Root struct {
+	dir string
+}
+
+var (
+	_ fs.FS         = (*Root)(nil)
+	_ fs.StatFS     = (*Root)(nil)
+	_ fs.ReadFileFS = (*Root)(nil)
+	_ fs.ReadDirFS  = (*Root)(nil)
+	_ fs.SubFS      = (*Root)(nil)
+)
+
+func OpenRoot(dir string) (*Root, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &fs.PathError{Op: "openroot", Path: dir, Err: errors.New("not a directory")}
+	}
+
+	return &Root{dir: dir}, nil
+}
+
+// Name returns the absolute directory of the root.
+func (r *Root) Name() string {
+	return r.dir
+}
+
+// Join resolves name to a path on disk that is guaranteed to be inside the root.
+func (r *Root) Join(name string) (string, error) {
+	return resolveIn(r.dir, "join", name, true)
+}
+
+func (r *Root) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	f, err := r.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (r *Root) OpenFile(name string, flag int, perm fs.FileMode) (*os.File, error) {
+	p, err := resolveIn(r.dir, "open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(p, flag, perm)
+}
+
+func (r *Root) Create(name string) (*os.File, error) {
+	return r.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (r *Root) Mkdir(name string, perm fs.FileMode) error {
+	p, err := resolveIn(r.dir, "mkdir", name, false)
+	if err != nil {
+		return err
+	}
+	return os.Mkdir(p, perm)
+}
+
+func (r *Root) MkdirAll(name string, perm fs.FileMode) error {
+	p, err := resolveIn(r.dir, "mkdir", name, true)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(p, perm)
+}
+
+// Remove removes the named file or empty directory. A symlink is removed
+// itself, not its target.
+func (r *Root) Remove(name string) error {
+	p, err := resolveIn(r.dir, "remove", name, false)
+	if err != nil {
+		return err
+	}
+	if p == r.dir {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrInvalid}
+	}
+	return os.Remove(p)
+}
+
+func (r *Root) RemoveAll(name string) error {
+	p, err := resolveIn(r.dir, "remove", name, false)
+	if err != nil {
+		return err
+	}
+	if p == r.dir {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrInvalid}
+	}
+	return os.RemoveAll(p)
+}
+
+func (r *Root) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+
+	p, err := resolveIn(r.dir, "stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(p)
+}
+
+func (r *Root) Lstat(name string) (fs.FileInfo, error) {
+	p, err := resolveIn(r.dir, "lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return os.Lstat(p)
+}
+
+func (r *Root) ReadFile(name string) ([]byte, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: fs.ErrInvalid}
+	}
+
+	p, err := resolveIn(r.dir, "readfile", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(p)
+}
+
+func (r *Root) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	p, err := resolveIn(r.dir, "writefile", name, true)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(p, data, perm)
+}
+
+func (r *Root) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+
+	p, err := resolveIn(r.dir, "readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadDir(p)
+}
+
+// Sub returns the Root of the directory name.
+func (r *Root) Sub(name string) (fs.FS, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "sub", Path: name, Err: fs.ErrInvalid}
+	}
+
+	p, err := resolveIn(r.dir, "sub", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return OpenRoot(p)
+}
+
+// Walk walks the tree below name with fs.WalkDir. Symlinks are reported
+// but not followed.
+func (r *Root) Walk(name string, fn fs.WalkDirFunc) error {
+	return fs.WalkDir(r, name, fn)
+}
+
+// resolveIn maps the slash separated name onto a path below root,
+// resolving `..` and symlinks one component at a time. The last component
+// is only resolved if followLast is set. Components that do not exist yet
+// are joined lexically.
+func resolveIn(root, op, name string, followLast bool) (string, error) {
+	escape := &fs.PathError{Op: op, Path: name, Err: ErrPathEscape}
+	if path.IsAbs(name) {
+		return "", escape
+	}
+
+	var (
+		parts []string
+		queue = strings.Split(name, "/")
+		links int
+	)
+
+	for len(queue) > 0 {
+		part := queue[0]
+		queue = queue[1:]
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if len(parts) == 0 {
+				return "", escape
+			}
+			parts = parts[:len(parts)-1]
+			continue
+		}
+
+		if len(queue) == 0 && !followLast {
+			parts = append(parts, part)
+			break
+		}
+
+		cur := filepath.Join(root, filepath.Join(parts...), part)
+		info, err := os.Lstat(cur)
+		if err != nil || info.Mode()&fs.ModeSymlink == 0 {
+			parts = append(parts, part)
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", &fs.PathError{Op: op, Path: name, Err: errors.New("too many levels of symbolic links")}
+		}
+
+		target, err := os.Readlink(cur)
+		if err != nil {
+			return "", &fs.PathError{Op: op, Path: name, Err: err}
+		}
+		if filepath.IsAbs(target) {
+			return "", escape
+		}
+		queue = append(strings.Split(filepath.ToSlash(target), "/"), queue...)
+	}
+
+	return filepath.Join(root, filepath.Join(parts...)), nil
+}
@@ -0,0 +1,442 @@
+package bhfs
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/buhuang1002/bh-go-tools/bhio"
+)
+
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+type RotateOptions struct {
+	// MaxSize rotates before a write would grow the file beyond it.
+	MaxSize int64
+	// MaxAge rotates files that have been open for longer.
+	MaxAge time.Duration
+	// Daily rotates at local midnight.
+	Daily bool
+	// MaxBackups keeps at most that many rotated segments.
+	MaxBackups int
+	// MaxBackupAge removes rotated segments older than it.
+	MaxBackupAge time.Duration
+	// Compress gzips rotated segments in the background.
+	Compress bool
+	// Perm is used for newly created files. Defaults to 0644.
+	Perm fs.FileMode
+}
+
+// RotatingWriter appends to filename and moves it aside to a timestamped
+// backup whenever one of the configured limits is hit.
+type RotatingWriter struct {
+	filename string
+	opts     RotateOptions
+
+	mu       sync.Mutex
+	f        *os.File
+	size     int64
+	deadline time.Time
+	closed   bool
+
+	mill     chan struct{}
+	millDone chan struct{}
+}
+
+var _ bhio.WrapWriter = &RotatingWriter{}
+
+func NewRotatingWriter(filename string, opts RotateOptions) (*RotatingWriter, error) {
+	if opts.Perm == 0 {
+		opts.Perm = 0644
+	}
+
+	rw := &RotatingWriter{
+		filename: filename,
+		opts:     opts,
+		mill:     make(chan struct{}, 1),
+		millDone: make(chan struct{}),
+	}
+
+	if err := rw.open(); err != nil {
+		return nil, err
+	}
+
+	go rw.runMill()
+	rw.triggerMill()
+	return rw, nil
+}
+
+func (rw *RotatingWriter) Write(p []byte) (int, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	if rw.closed {
+		return 0, os.ErrClosed
+	}
+	if err := rw.ensureOpen(); err != nil {
+		return 0, err
+	}
+
+	if rw.shouldRotate(int64(len(p))) {
+		if err := rw.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rw.f.Write(p)
+	rw.size += int64(n)
+	return n, err
+}
+
+// Rotate moves the current file aside and starts a new one.
+func (rw *RotatingWriter) Rotate() error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	if rw.closed {
+		return os.ErrClosed
+	}
+	if err := rw.ensureOpen(); err != nil {
+		return err
+	}
+	return rw.rotate()
+}
+
+// Reopen closes and reopens filename, for files moved away by an external
+// tool such as logrotate.
+func (rw *RotatingWriter) Reopen() error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	if rw.closed {
+		return os.ErrClosed
+	}
+
+	// the new file is opened first, so the old one stays in use on failure
+	old := rw.f
+	if err := rw.open(); err != nil {
+		return err
+	}
+	if old == nil {
+		return nil
+	}
+	return old.Close()
+}
+
+// ReopenOnSignal calls Reopen whenever one of sigs arrives, SIGHUP by
+// default. The returned function stops listening.
+func (rw *RotatingWriter) ReopenOnSignal(sigs ...os.Signal) (stop func()) {
+	if len(sigs) == 0 {
+		sigs = []os.Signal{syscall.SIGHUP}
+	}
+
+	c := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(c, sigs...)
+
+	go func() {
+		for {
+			select {
+			case <-c:
+				rw.Reopen()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(c)
+			close(done)
+		})
+	}
+}
+
+func (rw *RotatingWriter) Sync() error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	if rw.closed {
+		return os.ErrClosed
+	}
+	if err := rw.ensureOpen(); err != nil {
+		return err
+	}
+	return rw.f.Sync()
+}
+
+// Close closes the current file and waits for background compression.
+func (rw *RotatingWriter) Close() error {
+	rw.mu.Lock()
+	if rw.closed {
+		rw.mu.Unlock()
+		return nil
+	}
+	rw.closed = true
+	var err error
+	if rw.f != nil {
+		err = rw.f.Close()
+	}
+	rw.mu.Unlock()
+
+	close(rw.mill)
+	<-rw.millDone
+	return err
+}
+
+// UnwrapWriter returns the currently open file, nil if it could not be
+// opened again.
+func (rw *RotatingWriter) UnwrapWriter() io.Writer {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	if rw.f == nil {
+		return nil
+	}
+	return rw.f
+}
+
+func (rw *RotatingWriter) shouldRotate(n int64) bool {
+	if rw.opts.MaxSize > 0 && rw.size > 0 && rw.size+n > rw.opts.MaxSize {
+		return true
+	}
+	return !rw.deadline.IsZero() && !time.Now().Before(rw.deadline)
+}
+
+// ensureOpen retries opening filename after Rotate failed to.
+func (rw *RotatingWriter) ensureOpen() error {
+	if rw.f != nil {
+		return nil
+	}
+	return rw.open()
+}
+
+func (rw *RotatingWriter) open() error {
+	if err := os.MkdirAll(filepath.Dir(rw.filename), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(rw.filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, rw.opts.Perm)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	rw.f = f
+	rw.size = info.Size()
+	rw.deadline = rw.nextDeadline(time.Now())
+	return nil
+}
+
+func (rw *RotatingWriter) nextDeadline(now time.Time) time.Time {
+	var deadline time.Time
+	if rw.opts.MaxAge > 0 {
+		deadline = now.Add(rw.opts.MaxAge)
+	}
+	if rw.opts.Daily {
+		y, m, d := now.Date()
+		midnight := time.Date(y, m, d+1, 0, 0, 0, 0, now.Location())
+		if deadline.IsZero() || midnight.Before(deadline) {
+			deadline = midnight
+		}
+	}
+	return deadline
+}
+
+func (rw *RotatingWriter) rotate() error {
+	err := rw.f.Close()
+	if err == nil {
+		err = os.Rename(rw.filename, rw.backupName(time.Now()))
+		if errors.Is(err, fs.ErrNotExist) {
+			err = nil
+		}
+	}
+
+	// on failure the old file is opened again, a later write retries
+	if oerr := rw.open(); oerr != nil {
+		rw.f = nil
+		return errors.Join(err, oerr)
+	}
+	if err != nil {
+		return err
+	}
+
+	rw.triggerMill()
+	return nil
+}
+
+// backupName returns an unused backup name for t. Backups rotated within the
+// same millisecond get a counter suffix, compressed or not.
+func (rw *RotatingWriter) backupName(t time.Time) string {
+	dir, base := filepath.Split(rw.filename)
+	ext := filepath.Ext(base)
+	stamp := strings.TrimSuffix(base, ext) + "-" + t.Format(backupTimeFormat)
+
+	for seq := 0; ; seq++ {
+		name := stamp
+		if seq > 0 {
+			name += "-" + strconv.Itoa(seq)
+		}
+		name = filepath.Join(dir, name+ext)
+		if !fileExists(name) && !fileExists(name+".gz") {
+			return name
+		}
+	}
+}
+
+func fileExists(name string) bool {
+	_, err := os.Lstat(name)
+	return err == nil
+}
+
+func (rw *RotatingWriter) triggerMill() {
+	select {
+	case rw.mill <- struct{}{}:
+	default:
+	}
+}
+
+// runMill compresses rotated segments and enforces retention, one batch at a time.
+func (rw *RotatingWriter) runMill() {
+	defer close(rw.millDone)
+	for range rw.mill {
+		rw.millOnce()
+	}
+}
+
+type backupFile struct {
+	path string
+	t    time.Time
+	seq  int
+}
+
+func (rw *RotatingWriter) millOnce() {
+	backups := rw.backups()
+
+	var keep []backupFile
+	for i, b := range backups {
+		expired := rw.opts.MaxBackupAge > 0 && time.Since(b.t) > rw.opts.MaxBackupAge
+		tooMany := rw.opts.MaxBackups > 0 && i >= rw.opts.MaxBackups
+		if expired || tooMany {
+			os.Remove(b.path)
+			continue
+		}
+		keep = append(keep, b)
+	}
+
+	if !rw.opts.Compress {
+		return
+	}
+	for _, b := range keep {
+		if !strings.HasSuffix(b.path, ".gz") {
+			compressFile(b.path)
+		}
+	}
+}
+
+// backups lists rotated segments, newest first.
+func (rw *RotatingWriter) backups() []backupFile {
+	dir, base := filepath.Split(rw.filename)
+	ext := filepath.Ext(base)
+	prefix := strings.TrimSuffix(base, ext) + "-"
+
+	entries, err := os.ReadDir(filepath.Clean(dir))
+	if err != nil {
+		return nil
+	}
+
+	var backups []backupFile
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		stamp := strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".gz")
+		if !strings.HasSuffix(stamp, ext) {
+			continue
+		}
+
+		stamp = strings.TrimSuffix(stamp, ext)
+		seq := 0
+		if len(stamp) > len(backupTimeFormat) {
+			suffix, ok := strings.CutPrefix(stamp[len(backupTimeFormat):], "-")
+			if !ok {
+				continue
+			}
+			var err error
+			if seq, err = strconv.Atoi(suffix); err != nil || seq < 1 {
+				continue
+			}
+			stamp = stamp[:len(backupTimeFormat)]
+		}
+
+		t, err := time.ParseInLocation(backupTimeFormat, stamp, time.Local)
+		if err != nil {
+			continue
+		}
+		backups = append(backups, backupFile{filepath.Join(dir, name), t, seq})
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		if backups[i].t.Equal(backups[j].t) {
+			return backups[i].seq > backups[j].seq
+		}
+		return backups[i].t.After(backups[j].t)
+	})
+	return backups
+}
+
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".gz.tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path+".gz")
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Remove(path)
+}
@@ -0,0 +1,169 @@
+package bhfs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+type FileKind int
+
+const (
+	// KindUnknown means the path could not be inspected, see StatResult.Err.
+	KindUnknown FileKind = iota
+	KindMissing
+	KindFile
+	KindDir
+	KindSymlink
+	KindBrokenSymlink
+	// KindOther covers devices, sockets and named pipes.
+	KindOther
+	KindPermissionDenied
+)
+
+func (k FileKind) String() string {
+	switch k {
+	case KindMissing:
+		return "missing"
+	case KindFile:
+		return "file"
+	case KindDir:
+		return "dir"
+	case KindSymlink:
+		return "symlink"
+	case KindBrokenSymlink:
+		return "broken symlink"
+	case KindOther:
+		return "other"
+	case KindPermissionDenied:
+		return "permission denied"
+	default:
+		return "unknown"
+	}
+}
+
+// StatResult tells what is at a path. Info comes from Lstat and Err holds
+// the error behind KindMissing, KindPermissionDenied and KindUnknown.
+type StatResult struct {
+	Path string
+	Kind FileKind
+	Info fs.FileInfo
+	Err  error
+}
+
+// Exists reports whether something, possibly a broken symlink, is at the path.
+func (sr StatResult) Exists() bool {
+	switch sr.Kind {
+	case KindFile, KindDir, KindSymlink, KindBrokenSymlink, KindOther:
+		return true
+	default:
+		return false
+	}
+}
+
+// Known reports whether the kind could be determined, i.e. the result is
+// neither KindPermissionDenied nor KindUnknown.
+func (sr StatResult) Known() bool {
+	return sr.Kind != KindPermissionDenied && sr.Kind != KindUnknown
+}
+
+// Stat inspects path without following a final symlink, unlike
+// FileIsExisted and IsDir it keeps "does not exist" apart from "can't tell".
+func Stat(path string) StatResult {
+	sr := StatResult{Path: path}
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		sr.Kind = errKind(err)
+		sr.Err = err
+		return sr
+	}
+	sr.Info = info
+
+	switch {
+	case info.Mode()&fs.ModeSymlink != 0:
+		_, err := os.Stat(path)
+		switch {
+		case err == nil:
+			sr.Kind = KindSymlink
+		case errKind(err) == KindMissing:
+			sr.Kind = KindBrokenSymlink
+			sr.Err = err
+		default:
+			sr.Kind = KindSymlink
+			sr.Err = err
+		}
+	case info.IsDir():
+		sr.Kind = KindDir
+	case info.Mode().IsRegular():
+		sr.Kind = KindFile
+	default:
+		sr.Kind = KindOther
+	}
+	return sr
+}
+
+func errKind(err error) FileKind {
+	switch {
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, syscall.ENOTDIR):
+		return KindMissing
+	case errors.Is(err, fs.ErrPermission):
+		return KindPermissionDenied
+	default:
+		return KindUnknown
+	}
+}
+
+// EnsureDir creates path and its parents with perm unless a directory,
+// or a symlink to one, is already there.
+func EnsureDir(path string, perm fs.FileMode) error {
+	sr := Stat(path)
+	switch sr.Kind {
+	case KindDir:
+		return nil
+	case KindSymlink:
+		if IsDir(path) {
+			return nil
+		}
+	case KindMissing:
+		return os.MkdirAll(path, perm)
+	case KindPermissionDenied, KindUnknown:
+		return sr.Err
+	}
+
+	return &fs.PathError{Op: "ensuredir", Path: path, Err: fmt.Errorf("exists as %s", sr.Kind)}
+}
+
+// EnsureFile creates an empty file with perm, and its parents, unless a
+// regular file, or a symlink to one, is already there.
+func EnsureFile(path string, perm fs.FileMode) error {
+	sr := Stat(path)
+	switch sr.Kind {
+	case KindFile:
+		return nil
+	case KindSymlink:
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			return nil
+		}
+	case KindMissing:
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+		if err != nil {
+			if errors.Is(err, fs.ErrExist) {
+				return EnsureFile(path, perm)
+			}
+			return err
+		}
+		return f.Close()
+	case KindPermissionDenied, KindUnknown:
+		return sr.Err
+	}
+
+	return &fs.PathError{Op: "ensurefile", Path: path, Err: fmt.Errorf("exists as %s", sr.Kind)}
+}
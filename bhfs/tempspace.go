@@ -0,0 +1,356 @@
+package bhfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tempSpaceMarker = ".pid"
+	tempSpaceGrace  = time.Minute
+)
+
+var ErrQuotaExceeded = errors.New("temp space quota exceeded")
+
+type TempSpaceOptions struct {
+	// Root is the directory holding all workspaces.
+	// Defaults to bhfs-tempspace in os.TempDir().
+	Root string
+	// Quota limits the bytes written through the TempSpace. Zero means unlimited.
+	Quota int64
+}
+
+// TempSpace is a workspace directory below a managed root. It is removed
+// on Close or when its context is done, and a pid marker lets
+// SweepTempSpaces find workspaces left behind by dead processes.
+type TempSpace struct {
+	dir    string
+	quota  int64
+	marker *PIDFile
+
+	mu     sync.Mutex
+	used   int64
+	paths  map[string]*TempFile
+	closed bool
+	stop   func() bool
+}
+
+// NewTempSpace sweeps stale workspaces below the root and creates a new one.
+func NewTempSpace(ctx context.Context, opts TempSpaceOptions) (*TempSpace, error) {
+	if opts.Root == "" {
+		opts.Root = filepath.Join(os.TempDir(), "bhfs-tempspace")
+	}
+	if err := os.MkdirAll(opts.Root, 0755); err != nil {
+		return nil, err
+	}
+
+	if _, err := SweepTempSpaces(opts.Root); err != nil {
+		return nil, err
+	}
+
+	dir, err := os.MkdirTemp(opts.Root, fmt.Sprintf("%d-", os.Getpid()))
+	if err != nil {
+		return nil, err
+	}
+
+	marker, err := CreatePIDFile(filepath.Join(dir, tempSpaceMarker))
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	ts := &TempSpace{
+		dir:    dir,
+		quota:  opts.Quota,
+		marker: marker,
+		paths:  map[string]*TempFile{},
+	}
+	ts.stop = context.AfterFunc(ctx, func() {
+		ts.close()
+	})
+	return ts, nil
+}
+
+// SweepTempSpaces removes workspaces below root whose owning process is
+// gone and returns their paths.
+func SweepTempSpaces(root string) ([]string, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+
+		dir := filepath.Join(root, e.Name())
+		unlock, stale := staleTempSpace(dir)
+		if !stale {
+			continue
+		}
+
+		err = os.RemoveAll(dir)
+		unlock()
+		if err != nil {
+			return removed, err
+		}
+		removed = append(removed, dir)
+	}
+	return removed, nil
+}
+
+// staleTempSpace locks the marker of dir and reports whether the workspace
+// is left behind. A workspace without a valid pid may still be being
+// created, it is stale only once it is older than tempSpaceGrace.
+func staleTempSpace(dir string) (unlock func(), stale bool) {
+	marker := filepath.Join(dir, tempSpaceMarker)
+
+	// not created here, that would get in the way of CreatePIDFile
+	f, err := os.OpenFile(marker, os.O_RDWR, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		info, err := os.Stat(dir)
+		if err != nil || time.Since(info.ModTime()) < tempSpaceGrace {
+			return nil, false
+		}
+		return func() {}, true
+	}
+	if err != nil {
+		return nil, false
+	}
+
+	ok, err := tryLockFile(f, true)
+	if err != nil || !ok {
+		// still owned
+		f.Close()
+		return nil, false
+	}
+	unlock = func() {
+		unlockFile(f)
+		f.Close()
+	}
+
+	// the owner holds the lock while it lives, whoever has its pid now
+	if _, err := ReadPIDFile(marker); err == nil {
+		return unlock, true
+	}
+	if info, err := f.Stat(); err == nil && time.Since(info.ModTime()) >= tempSpaceGrace {
+		// the owner died before writing its pid
+		return unlock, true
+	}
+
+	unlock()
+	return nil, false
+}
+
+func (ts *TempSpace) Dir() string {
+	return ts.dir
+}
+
+// MkdirTemp creates a new directory in dir, which is relative to the
+// workspace, like os.MkdirTemp.
+func (ts *TempSpace) MkdirTemp(dir, pattern string) (string, error) {
+	parent, err := ts.join(dir)
+	if err != nil {
+		return "", err
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.closed {
+		return "", os.ErrClosed
+	}
+
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return "", err
+	}
+
+	path, err := os.MkdirTemp(parent, pattern)
+	if err != nil {
+		return "", err
+	}
+
+	ts.paths[path] = nil
+	return path, nil
+}
+
+// CreateTemp creates a new file in dir, which is relative to the workspace,
+// like os.CreateTemp. Writes through the returned file count against the quota.
+func (ts *TempSpace) CreateTemp(dir, pattern string) (*TempFile, error) {
+	parent, err := ts.join(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.closed {
+		return nil, os.ErrClosed
+	}
+
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.CreateTemp(parent, pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	tf := &TempFile{File: f, ts: ts}
+	ts.paths[f.Name()] = tf
+	return tf, nil
+}
+
+// Remove deletes a tracked path and returns its quota.
+func (ts *TempSpace) Remove(path string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if _, ok := ts.paths[path]; !ok {
+		return fmt.Errorf("%s is not tracked by the temp space", path)
+	}
+
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+
+	// release everything tracked at or below path
+	for p, f := range ts.paths {
+		if p == path || strings.HasPrefix(p, path+string(filepath.Separator)) {
+			if f != nil {
+				f.File.Close()
+				ts.used -= f.size
+			}
+			delete(ts.paths, p)
+		}
+	}
+	return nil
+}
+
+// Paths returns every tracked directory and file.
+func (ts *TempSpace) Paths() []string {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	paths := make([]string, 0, len(ts.paths))
+	for p := range ts.paths {
+		paths = append(paths, p)
+	}
+	return paths
+}
+
+// Used returns the bytes counted against the quota.
+func (ts *TempSpace) Used() int64 {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.used
+}
+
+// Close removes the workspace with everything in it.
+func (ts *TempSpace) Close() error {
+	ts.stop()
+	return ts.close()
+}
+
+func (ts *TempSpace) close() error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.closed {
+		return nil
+	}
+	ts.closed = true
+
+	for _, f := range ts.paths {
+		if f != nil {
+			f.File.Close()
+		}
+	}
+	ts.paths = nil
+
+	err := os.RemoveAll(ts.dir)
+	// the marker is gone with the directory, only its lock remains
+	ts.marker.lock.Unlock()
+	return err
+}
+
+func (ts *TempSpace) join(dir string) (string, error) {
+	if dir == "" {
+		return ts.dir, nil
+	}
+	if filepath.IsAbs(dir) {
+		rel, err := filepath.Rel(ts.dir, dir)
+		if err != nil {
+			return "", err
+		}
+		dir = rel
+	}
+	return SafeJoin(ts.dir, dir)
+}
+
+// grow reserves quota for tf growing to end bytes. The size of every
+// TempFile is guarded by ts.mu, as writes may be concurrent.
+func (ts *TempSpace) grow(tf *TempFile, end int64) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if end <= tf.size {
+		return nil
+	}
+	if ts.quota > 0 && ts.used+end-tf.size > ts.quota {
+		return ErrQuotaExceeded
+	}
+	ts.used += end - tf.size
+	tf.size = end
+	return nil
+}
+
+// TempFile is a file created by a TempSpace.
+type TempFile struct {
+	*os.File
+	ts   *TempSpace
+	size int64 // guarded by ts.mu
+}
+
+func (tf *TempFile) Write(p []byte) (int, error) {
+	off, err := tf.File.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	if err := tf.reserve(off + int64(len(p))); err != nil {
+		return 0, err
+	}
+	return tf.File.Write(p)
+}
+
+func (tf *TempFile) WriteAt(p []byte, off int64) (int, error) {
+	if err := tf.reserve(off + int64(len(p))); err != nil {
+		return 0, err
+	}
+	return tf.File.WriteAt(p, off)
+}
+
+func (tf *TempFile) WriteString(s string) (int, error) {
+	return tf.Write([]byte(s))
+}
+
+// ReadFrom copies through Write so that the quota applies.
+func (tf *TempFile) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(struct{ io.Writer }{tf}, r)
+}
+
+func (tf *TempFile) reserve(end int64) error {
+	return tf.ts.grow(tf, end)
+}
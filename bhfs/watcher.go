@@ -0,0 +1,196 @@
+package bhfs
+
+import (
+	"context"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Op describes a set of file operations reported by a Watcher.
+type Op uint32
+
+const (
+	Create Op = 1 << iota
+	Write
+	Remove
+	Rename
+)
+
+// Has reports whether op contains all operations in h.
+func (op Op) Has(h Op) bool {
+	return op&h == h
+}
+
+func (op Op) String() string {
+	var names []string
+	for _, o := range []struct {
+		op   Op
+		name string
+	}{
+		{Create, "CREATE"},
+		{Write, "WRITE"},
+		{Remove, "REMOVE"},
+		{Rename, "RENAME"},
+	} {
+		if op.Has(o.op) {
+			names = append(names, o.name)
+		}
+	}
+
+	if len(names) == 0 {
+		return "NONE"
+	}
+
+	return strings.Join(names, "|")
+}
+
+// Event is a debounced change notification for a single path.
+// Ops seen for the same path within the debounce window are merged.
+type Event struct {
+	Name string
+	Op   Op
+}
+
+type WatcherOptions struct {
+	// Debounce is the quiet period after which merged events are delivered.
+	Debounce time.Duration
+	// PollInterval is the scan interval of the polling backend.
+	PollInterval time.Duration
+	// Recursive watches every directory below an added directory,
+	// including directories created later.
+	Recursive bool
+	// ForcePolling disables inotify even where it is available.
+	ForcePolling bool
+}
+
+const (
+	defaultDebounce     = 100 * time.Millisecond
+	defaultPollInterval = time.Second
+)
+
+type watchBackend interface {
+	add(name string) error
+	remove(name string) error
+	run(ctx context.Context, emit func(Event), fail func(error))
+	close() error
+}
+
+// Watcher delivers file system events on C until the context passed to Run
+// is done. Run fits the signature expected by bhrunner.TaskRunner.Go.
+type Watcher struct {
+	C      <-chan Event
+	Errors <-chan error
+
+	c       chan Event
+	errs    chan error
+	opts    WatcherOptions
+	backend watchBackend
+	running sync.Once
+}
+
+// NewWatcher creates a watcher backed by inotify on Linux, falling back to
+// polling when inotify is unavailable or ForcePolling is set.
+func NewWatcher(opts WatcherOptions) (*Watcher, error) {
+	if opts.Debounce <= 0 {
+		opts.Debounce = defaultDebounce
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = defaultPollInterval
+	}
+
+	backend, err := newWatchBackend(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	c := make(chan Event)
+	errs := make(chan error, 1)
+	return &Watcher{
+		C:       c,
+		Errors:  errs,
+		c:       c,
+		errs:    errs,
+		opts:    opts,
+		backend: backend,
+	}, nil
+}
+
+// Add starts watching name. Directories are watched recursively if
+// the watcher was created with Recursive.
+func (w *Watcher) Add(name string) error {
+	return w.backend.add(filepath.Clean(name))
+}
+
+// Remove stops watching name.
+func (w *Watcher) Remove(name string) error {
+	return w.backend.remove(filepath.Clean(name))
+}
+
+// Run dispatches events until ctx is done, then releases the backend and
+// closes C and Errors. Run must be called at most once.
+func (w *Watcher) Run(ctx context.Context) {
+	w.running.Do(func() {
+		w.run(ctx)
+	})
+}
+
+func (w *Watcher) run(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	raw := make(chan Event, 64)
+	backendDone := make(chan struct{})
+
+	defer func() {
+		cancel()
+		<-backendDone
+		w.backend.close()
+		close(w.c)
+		close(w.errs)
+	}()
+
+	go func() {
+		defer close(backendDone)
+		w.backend.run(ctx, func(ev Event) {
+			select {
+			case raw <- ev:
+			case <-ctx.Done():
+			}
+		}, func(err error) {
+			select {
+			case w.errs <- err:
+			default:
+			}
+		})
+	}()
+
+	pending := map[string]Op{}
+	timer := time.NewTimer(w.opts.Debounce)
+	timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-raw:
+			pending[ev.Name] |= ev.Op
+			timer.Reset(w.opts.Debounce)
+		case <-timer.C:
+			names := make([]string, 0, len(pending))
+			for name := range pending {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			for _, name := range names {
+				select {
+				case w.c <- Event{Name: name, Op: pending[name]}:
+				case <-ctx.Done():
+					return
+				}
+			}
+			pending = map[string]Op{}
+		}
+	}
+}
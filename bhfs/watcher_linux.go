@@ -0,0 +1,201 @@
+//go:build linux
+
+package bhfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE |
+	syscall.IN_DELETE | syscall.IN_DELETE_SELF | syscall.IN_MOVED_FROM |
+	syscall.IN_MOVED_TO | syscall.IN_MOVE_SELF
+
+func newWatchBackend(opts WatcherOptions) (watchBackend, error) {
+	if opts.ForcePolling {
+		return newPollBackend(opts), nil
+	}
+
+	ib, err := newInotifyBackend(opts)
+	if err != nil {
+		return newPollBackend(opts), nil
+	}
+	return ib, nil
+}
+
+type inotifyBackend struct {
+	mu        sync.Mutex
+	f         *os.File
+	fd        int
+	recursive bool
+	paths     map[int]string
+	wds       map[string]int
+}
+
+func newInotifyBackend(opts WatcherOptions) (*inotifyBackend, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+
+	return &inotifyBackend{
+		// a non-blocking fd is registered with the runtime poller,
+		// so closing f unblocks a pending Read
+		f:         os.NewFile(uintptr(fd), "inotify"),
+		fd:        fd,
+		recursive: opts.Recursive,
+		paths:     map[int]string{},
+		wds:       map[string]int{},
+	}, nil
+}
+
+func (ib *inotifyBackend) add(name string) error {
+	if !ib.recursive {
+		return ib.addWatch(name)
+	}
+
+	return filepath.WalkDir(name, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != name && !d.IsDir() {
+			return nil
+		}
+		return ib.addWatch(path)
+	})
+}
+
+func (ib *inotifyBackend) addWatch(name string) error {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+
+	wd, err := syscall.InotifyAddWatch(ib.fd, name, inotifyMask)
+	if err != nil {
+		return &os.PathError{Op: "inotify_add_watch", Path: name, Err: err}
+	}
+
+	ib.paths[wd] = name
+	ib.wds[name] = wd
+	return nil
+}
+
+func (ib *inotifyBackend) remove(name string) error {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+
+	wd, ok := ib.wds[name]
+	if !ok {
+		return errors.New("path is not watched")
+	}
+
+	if ib.recursive {
+		// the subdirectories were added along with name
+		prefix := name + string(filepath.Separator)
+		for path, sub := range ib.wds {
+			if strings.HasPrefix(path, prefix) {
+				ib.rmWatchLocked(path, sub)
+			}
+		}
+	}
+
+	if err := ib.rmWatchLocked(name, wd); err != nil {
+		return &os.PathError{Op: "inotify_rm_watch", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (ib *inotifyBackend) rmWatchLocked(name string, wd int) error {
+	delete(ib.wds, name)
+	delete(ib.paths, wd)
+	_, err := syscall.InotifyRmWatch(ib.fd, uint32(wd))
+	return err
+}
+
+func (ib *inotifyBackend) run(ctx context.Context, emit func(Event), fail func(error)) {
+	go func() {
+		<-ctx.Done()
+		ib.f.Close()
+	}()
+
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := ib.f.Read(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				fail(err)
+			}
+			return
+		}
+
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			nameBytes := buf[off+syscall.SizeofInotifyEvent : off+syscall.SizeofInotifyEvent+int(raw.Len)]
+			off += syscall.SizeofInotifyEvent + int(raw.Len)
+
+			if raw.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				fail(errors.New("inotify event queue overflowed"))
+				continue
+			}
+
+			ev, ok := ib.translate(int(raw.Wd), raw.Mask, string(bytes.TrimRight(nameBytes, "\x00")))
+			if ok {
+				emit(ev)
+			}
+		}
+	}
+}
+
+func (ib *inotifyBackend) translate(wd int, mask uint32, name string) (Event, bool) {
+	ib.mu.Lock()
+	dir, ok := ib.paths[wd]
+	if mask&syscall.IN_IGNORED != 0 && ok {
+		delete(ib.paths, wd)
+		delete(ib.wds, dir)
+	}
+	ib.mu.Unlock()
+
+	if !ok {
+		return Event{}, false
+	}
+
+	path := dir
+	if name != "" {
+		path = filepath.Join(dir, name)
+	}
+
+	var op Op
+	switch {
+	case mask&syscall.IN_CREATE != 0, mask&syscall.IN_MOVED_TO != 0:
+		op = Create
+		if mask&syscall.IN_ISDIR != 0 && ib.recursive {
+			// errors are ignored, the directory may already be gone again
+			ib.add(path)
+		}
+	case mask&(syscall.IN_MODIFY|syscall.IN_CLOSE_WRITE) != 0:
+		op = Write
+	case mask&(syscall.IN_DELETE|syscall.IN_DELETE_SELF) != 0:
+		op = Remove
+	case mask&(syscall.IN_MOVED_FROM|syscall.IN_MOVE_SELF) != 0:
+		op = Rename
+	default:
+		return Event{}, false
+	}
+
+	return Event{Name: path, Op: op}, true
+}
+
+func (ib *inotifyBackend) close() error {
+	err := ib.f.Close()
+	if errors.Is(err, os.ErrClosed) {
+		return nil
+	}
+	return err
+}
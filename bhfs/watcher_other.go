@@ -0,0 +1,7 @@
+//go:build !linux
+
+package bhfs
+
+func newWatchBackend(opts WatcherOptions) (watchBackend, error) {
+	return newPollBackend(opts), nil
+}
@@ -0,0 +1,150 @@
+package bhfs
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type pollState struct {
+	size    int64
+	modTime time.Time
+	mode    fs.FileMode
+}
+
+// pollBackend detects changes by periodically comparing stat snapshots.
+// It cannot tell a rename apart from a remove followed by a create.
+type pollBackend struct {
+	mu        sync.Mutex
+	interval  time.Duration
+	recursive bool
+	roots     map[string]struct{}
+	states    map[string]pollState
+}
+
+func newPollBackend(opts WatcherOptions) *pollBackend {
+	return &pollBackend{
+		interval:  opts.PollInterval,
+		recursive: opts.Recursive,
+		roots:     map[string]struct{}{},
+		states:    map[string]pollState{},
+	}
+}
+
+func (pb *pollBackend) add(name string) error {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	if _, err := os.Lstat(name); err != nil {
+		return err
+	}
+
+	pb.roots[name] = struct{}{}
+	for path, st := range pb.scan(name) {
+		pb.states[path] = st
+	}
+	return nil
+}
+
+func (pb *pollBackend) remove(name string) error {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	if _, ok := pb.roots[name]; !ok {
+		return errors.New("path is not watched")
+	}
+
+	delete(pb.roots, name)
+	for path := range pb.scan(name) {
+		delete(pb.states, path)
+	}
+	return nil
+}
+
+func (pb *pollBackend) run(ctx context.Context, emit func(Event), fail func(error)) {
+	ticker := time.NewTicker(pb.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, ev := range pb.diff() {
+				emit(ev)
+			}
+		}
+	}
+}
+
+func (pb *pollBackend) close() error {
+	return nil
+}
+
+func (pb *pollBackend) diff() []Event {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+
+	current := map[string]pollState{}
+	for root := range pb.roots {
+		for path, st := range pb.scan(root) {
+			current[path] = st
+		}
+	}
+
+	var events []Event
+	for path, st := range current {
+		old, ok := pb.states[path]
+		switch {
+		case !ok:
+			events = append(events, Event{Name: path, Op: Create})
+		case old != st && !st.mode.IsDir():
+			events = append(events, Event{Name: path, Op: Write})
+		}
+	}
+	for path := range pb.states {
+		if _, ok := current[path]; !ok {
+			events = append(events, Event{Name: path, Op: Remove})
+		}
+	}
+
+	pb.states = current
+	return events
+}
+
+// scan returns the state of root and, for directories, its entries.
+// Subdirectories are descended into only when recursive.
+func (pb *pollBackend) scan(root string) map[string]pollState {
+	states := map[string]pollState{}
+	info, err := os.Lstat(root)
+	if err != nil {
+		return states
+	}
+
+	states[root] = pollState{info.Size(), info.ModTime(), info.Mode()}
+	if !info.IsDir() {
+		return states
+	}
+
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == root {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+
+		states[path] = pollState{info.Size(), info.ModTime(), info.Mode()}
+		if d.IsDir() && !pb.recursive {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return states
+}
@@ -0,0 +1,231 @@
+package bhio
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+)
+
+var (
+	ErrFrameTooLarge = errors.New("frame too large")
+	ErrFrameChecksum = errors.New("frame checksum mismatch")
+)
+
+const defaultMaxFrameSize = 4 << 20
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// FramePrefix is the encoding of the length in front of every frame.
+type FramePrefix int
+
+const (
+	PrefixVarint FramePrefix = iota
+	PrefixUint16
+	PrefixUint32
+)
+
+// FrameOptions must be the same on both ends.
+type FrameOptions struct {
+	Prefix FramePrefix
+	// MaxSize is the largest payload accepted, 4 MiB by default.
+	MaxSize int
+	// CRC appends a CRC-32C of the payload to every frame.
+	CRC bool
+}
+
+func (o FrameOptions) maxSize() int {
+	limit := o.MaxSize
+	if limit <= 0 {
+		limit = defaultMaxFrameSize
+	}
+	if o.Prefix == PrefixUint16 {
+		limit = min(limit, 1<<16-1)
+	}
+	return limit
+}
+
+// FrameWriter writes every Write as one frame. It is safe for concurrent use.
+type FrameWriter struct {
+	w    io.Writer
+	opts FrameOptions
+	mu   sync.Mutex
+	buf  []byte
+}
+
+func NewFrameWriter(w io.Writer, opts FrameOptions) *FrameWriter {
+	return &FrameWriter{
+		w:    w,
+		opts: opts,
+	}
+}
+
+func (fw *FrameWriter) Write(p []byte) (int, error) {
+	if err := fw.WriteFrame(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// WriteFrame writes p as one frame with a single Write to the underlying writer.
+func (fw *FrameWriter) WriteFrame(p []byte) error {
+	if len(p) > fw.opts.maxSize() {
+		return fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, len(p))
+	}
+
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	buf := fw.buf[:0]
+	switch fw.opts.Prefix {
+	case PrefixUint16:
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(p)))
+	case PrefixUint32:
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(p)))
+	default:
+		buf = binary.AppendUvarint(buf, uint64(len(p)))
+	}
+	buf = append(buf, p...)
+	if fw.opts.CRC {
+		buf = binary.BigEndian.AppendUint32(buf, crc32.Checksum(p, crcTable))
+	}
+	fw.buf = buf
+
+	n, err := fw.w.Write(buf)
+	if err == nil && n != len(buf) {
+		err = io.ErrShortWrite
+	}
+	return err
+}
+
+func (fw *FrameWriter) UnwrapWriter() io.Writer {
+	return fw.w
+}
+
+var _ WrapWriter = &FrameWriter{}
+
+// FrameReader reads the frames written by a FrameWriter. Read returns the
+// payloads as one stream, ReadFrame one frame at a time. The underlying
+// reader is buffered unless it is an io.ByteReader.
+type FrameReader struct {
+	r  io.Reader
+	br interface {
+		io.Reader
+		io.ByteReader
+	}
+	opts FrameOptions
+	rest []byte
+}
+
+func NewFrameReader(r io.Reader, opts FrameOptions) *FrameReader {
+	fr := &FrameReader{
+		r:    r,
+		opts: opts,
+	}
+	if br, ok := r.(interface {
+		io.Reader
+		io.ByteReader
+	}); ok {
+		fr.br = br
+	} else {
+		fr.br = bufio.NewReader(r)
+	}
+	return fr
+}
+
+func (fr *FrameReader) Read(p []byte) (int, error) {
+	for len(fr.rest) == 0 {
+		frame, err := fr.ReadFrame()
+		if err != nil {
+			return 0, err
+		}
+		fr.rest = frame
+	}
+
+	n := copy(p, fr.rest)
+	fr.rest = fr.rest[n:]
+	return n, nil
+}
+
+// ReadFrame returns the next payload. io.EOF is only returned between
+// frames, a truncated frame gives io.ErrUnexpectedEOF.
+func (fr *FrameReader) ReadFrame() ([]byte, error) {
+	size, err := fr.readSize()
+	if err != nil {
+		return nil, err
+	}
+	if size > uint64(fr.opts.maxSize()) {
+		return nil, fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, size)
+	}
+
+	n := int(size)
+	if fr.opts.CRC {
+		n += 4
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(fr.br, frame); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	if fr.opts.CRC {
+		frame, sum := frame[:size], frame[size:]
+		if crc32.Checksum(frame, crcTable) != binary.BigEndian.Uint32(sum) {
+			return nil, ErrFrameChecksum
+		}
+		return frame, nil
+	}
+	return frame, nil
+}
+
+func (fr *FrameReader) readSize() (uint64, error) {
+	switch fr.opts.Prefix {
+	case PrefixUint16, PrefixUint32:
+		b := make([]byte, 2)
+		if fr.opts.Prefix == PrefixUint32 {
+			b = make([]byte, 4)
+		}
+		if n, err := io.ReadFull(fr.br, b); err != nil {
+			if n > 0 {
+				return 0, unexpectedEOF(err)
+			}
+			return 0, err
+		}
+		if len(b) == 2 {
+			return uint64(binary.BigEndian.Uint16(b)), nil
+		}
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	default:
+		first, err := fr.br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if first < 0x80 {
+			return uint64(first), nil
+		}
+
+		size, err := binary.ReadUvarint(fr.br)
+		if err != nil {
+			return 0, unexpectedEOF(err)
+		}
+		if size > (1<<64-1)>>7 {
+			return 0, ErrFrameTooLarge
+		}
+		return size<<7 | uint64(first&0x7f), nil
+	}
+}
+
+func (fr *FrameReader) UnwrapReader() io.Reader {
+	return fr.r
+}
+
+var _ WrapReader = &FrameReader{}
+
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
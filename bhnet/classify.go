@@ -0,0 +1,165 @@
+package bhnet
+
+import (
+	"net"
+	"net/netip"
+	"slices"
+)
+
+// IPCategory is the special-purpose range an address belongs to.
+type IPCategory int
+
+const (
+	CategoryInvalid IPCategory = iota
+	// CategoryPublic is any address outside of the special ranges below.
+	CategoryPublic
+	CategoryUnspecified
+	CategoryLoopback
+	// CategoryPrivate is RFC 1918 space.
+	CategoryPrivate
+	// CategorySharedCGNAT is 100.64.0.0/10 from RFC 6598.
+	CategorySharedCGNAT
+	CategoryLinkLocal
+	// CategoryULA is fc00::/7 from RFC 4193.
+	CategoryULA
+	CategoryDocumentation
+	CategoryBenchmarking
+	CategoryMulticast
+	CategoryBroadcast
+	// CategoryReserved covers 0.0.0.0/8 and 240.0.0.0/4.
+	CategoryReserved
+	// CategoryIPv4Mapped is ::ffff:0:0/96. Use netip.Addr.Unmap to classify
+	// the embedded IPv4 address.
+	CategoryIPv4Mapped
+)
+
+func (c IPCategory) String() string {
+	switch c {
+	case CategoryPublic:
+		return "public"
+	case CategoryUnspecified:
+		return "unspecified"
+	case CategoryLoopback:
+		return "loopback"
+	case CategoryPrivate:
+		return "private"
+	case CategorySharedCGNAT:
+		return "shared-cgnat"
+	case CategoryLinkLocal:
+		return "link-local"
+	case CategoryULA:
+		return "unique-local"
+	case CategoryDocumentation:
+		return "documentation"
+	case CategoryBenchmarking:
+		return "benchmarking"
+	case CategoryMulticast:
+		return "multicast"
+	case CategoryBroadcast:
+		return "broadcast"
+	case CategoryReserved:
+		return "reserved"
+	case CategoryIPv4Mapped:
+		return "ipv4-mapped"
+	default:
+		return "invalid"
+	}
+}
+
+type categoryRange struct {
+	prefix   netip.Prefix
+	category IPCategory
+}
+
+// specialRanges is checked in order, so more specific prefixes come first.
+var specialRanges = []categoryRange{
+	{netip.MustParsePrefix("0.0.0.0/32"), CategoryUnspecified},
+	{netip.MustParsePrefix("0.0.0.0/8"), CategoryReserved},
+	{netip.MustParsePrefix("10.0.0.0/8"), CategoryPrivate},
+	{netip.MustParsePrefix("100.64.0.0/10"), CategorySharedCGNAT},
+	{netip.MustParsePrefix("127.0.0.0/8"), CategoryLoopback},
+	{netip.MustParsePrefix("169.254.0.0/16"), CategoryLinkLocal},
+	{netip.MustParsePrefix("172.16.0.0/12"), CategoryPrivate},
+	{netip.MustParsePrefix("192.0.2.0/24"), CategoryDocumentation},
+	{netip.MustParsePrefix("192.168.0.0/16"), CategoryPrivate},
+	{netip.MustParsePrefix("198.18.0.0/15"), CategoryBenchmarking},
+	{netip.MustParsePrefix("198.51.100.0/24"), CategoryDocumentation},
+	{netip.MustParsePrefix("203.0.113.0/24"), CategoryDocumentation},
+	{netip.MustParsePrefix("224.0.0.0/4"), CategoryMulticast},
+	{netip.MustParsePrefix("255.255.255.255/32"), CategoryBroadcast},
+	{netip.MustParsePrefix("240.0.0.0/4"), CategoryReserved},
+
+	{netip.MustParsePrefix("::/128"), CategoryUnspecified},
+	{netip.MustParsePrefix("::1/128"), CategoryLoopback},
+	{netip.MustParsePrefix("::ffff:0:0/96"), CategoryIPv4Mapped},
+	{netip.MustParsePrefix("2001:2::/48"), CategoryBenchmarking},
+	{netip.MustParsePrefix("2001:db8::/32"), CategoryDocumentation},
+	{netip.MustParsePrefix("3fff::/20"), CategoryDocumentation},
+	{netip.MustParsePrefix("fc00::/7"), CategoryULA},
+	{netip.MustParsePrefix("fe80::/10"), CategoryLinkLocal},
+	{netip.MustParsePrefix("ff00::/8"), CategoryMulticast},
+}
+
+// Classify returns the category of addr. Zones are ignored.
+func Classify(addr netip.Addr) IPCategory {
+	if !addr.IsValid() {
+		return CategoryInvalid
+	}
+
+	addr = addr.WithZone("")
+	for _, r := range specialRanges {
+		if r.prefix.Contains(addr) {
+			return r.category
+		}
+	}
+	return CategoryPublic
+}
+
+// ClassifyIP is Classify for net.IP. A net.IP does not distinguish IPv4
+// from IPv4-mapped IPv6, so both are classified as IPv4.
+func ClassifyIP(ip net.IP) IPCategory {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return CategoryInvalid
+	}
+	return Classify(addr.Unmap())
+}
+
+type PrivateIpOptions struct {
+	// IPv6 includes IPv6 addresses.
+	IPv6 bool
+	// Categories selects the addresses to return. Defaults to
+	// CategoryPrivate, plus CategoryULA if IPv6 is set.
+	Categories []IPCategory
+}
+
+// GetPrivateIpWithOptions is GetPrivateIp with a configurable set of
+// categories, and it reports interface errors instead of hiding them.
+func GetPrivateIpWithOptions(opts PrivateIpOptions) ([]string, error) {
+	if len(opts.Categories) == 0 {
+		opts.Categories = []IPCategory{CategoryPrivate}
+		if opts.IPv6 {
+			opts.Categories = append(opts.Categories, CategoryULA)
+		}
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var ipList []string
+	for _, address := range addrs {
+		ipnet, ok := address.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ipnet.IP.To4() == nil && !opts.IPv6 {
+			continue
+		}
+		if slices.Contains(opts.Categories, ClassifyIP(ipnet.IP)) {
+			ipList = append(ipList, ipnet.IP.String())
+		}
+	}
+	return ipList, nil
+}
@@ -0,0 +1,377 @@
+package bhnet
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/buhuang1002/bh-go-tools/bhsync"
+)
+
+var ErrPoolClosed = errors.New("connection pool closed")
+
+const defaultMaxIdle = 2
+
+type ConnPoolOptions struct {
+	// Dial opens a new connection, by default a TCP connection.
+	Dial func(ctx context.Context, addr string) (net.Conn, error)
+	// MaxIdle is the number of idle connections kept per address. Zero
+	// means 2, a negative value keeps none.
+	MaxIdle int
+	// MaxOpen limits the connections per address, idle ones included.
+	// Zero means unlimited.
+	MaxOpen int
+	// IdleTimeout closes connections idle for longer. Zero keeps them.
+	IdleTimeout time.Duration
+	// CheckAlive tests an idle connection before it is handed out. By
+	// default a connection closed by the peer, or with unread data, is dead.
+	CheckAlive func(net.Conn) error
+}
+
+type ConnPoolStats struct {
+	Open    int
+	Idle    int
+	Waiting int
+}
+
+// ConnPool keeps connections per address for reuse. Every address has
+// its own lock, so a slow backend never blocks the others.
+type ConnPool struct {
+	opts  ConnPoolOptions
+	locks *bhsync.MapMutex[string]
+
+	mu     sync.Mutex
+	hosts  map[string]*hostPool
+	closed chan struct{}
+	done   chan struct{}
+}
+
+// hostPool is guarded by the pool's lock of its address.
+type hostPool struct {
+	idle    []idleConn
+	open    int
+	waiters []chan net.Conn
+}
+
+type idleConn struct {
+	c     net.Conn
+	since time.Time
+}
+
+func NewConnPool(opts ConnPoolOptions) *ConnPool {
+	if opts.Dial == nil {
+		var d net.Dialer
+		opts.Dial = func(ctx context.Context, addr string) (net.Conn, error) {
+			return d.DialContext(ctx, "tcp", addr)
+		}
+	}
+	if opts.MaxIdle == 0 {
+		opts.MaxIdle = defaultMaxIdle
+	}
+	if opts.CheckAlive == nil {
+		opts.CheckAlive = checkConnAlive
+	}
+
+	p := &ConnPool{
+		opts:   opts,
+		locks:  bhsync.NewMapMutex[string](),
+		hosts:  map[string]*hostPool{},
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if opts.IdleTimeout > 0 {
+		go p.evictLoop()
+	} else {
+		close(p.done)
+	}
+	return p
+}
+
+// Get returns an idle connection to addr, or dials a new one. With MaxOpen
+// reached it waits for a connection to be returned or ctx to be done.
+func (p *ConnPool) Get(ctx context.Context, addr string) (*PooledConn, error) {
+	h, err := p.host(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		c, dial, wait := p.checkout(addr, h)
+		if wait != nil {
+			select {
+			case c = <-wait:
+			case <-ctx.Done():
+				p.cancelWait(addr, h, wait)
+				return nil, ctx.Err()
+			case <-p.closed:
+				p.cancelWait(addr, h, wait)
+				return nil, ErrPoolClosed
+			}
+			// a nil connection hands over an open slot
+			dial = c == nil
+		}
+
+		if dial {
+			c, err := p.opts.Dial(ctx, addr)
+			if err != nil {
+				p.locks.Lock(addr)
+				p.releaseLocked(h)
+				p.locks.Unlock(addr)
+				return nil, err
+			}
+			return &PooledConn{Conn: c, pool: p, addr: addr, host: h}, nil
+		}
+
+		if p.opts.CheckAlive(c) == nil {
+			return &PooledConn{Conn: c, pool: p, addr: addr, host: h}, nil
+		}
+
+		c.Close()
+		p.locks.Lock(addr)
+		p.releaseLocked(h)
+		p.locks.Unlock(addr)
+	}
+}
+
+// Stats returns the counters of addr.
+func (p *ConnPool) Stats(addr string) ConnPoolStats {
+	p.mu.Lock()
+	h, ok := p.hosts[addr]
+	p.mu.Unlock()
+	if !ok {
+		return ConnPoolStats{}
+	}
+
+	p.locks.Lock(addr)
+	defer p.locks.Unlock(addr)
+	return ConnPoolStats{Open: h.open, Idle: len(h.idle), Waiting: len(h.waiters)}
+}
+
+// Close closes the idle connections and fails waiting Gets. Connections
+// in use are closed when they are returned.
+func (p *ConnPool) Close() error {
+	p.mu.Lock()
+	select {
+	case <-p.closed:
+		p.mu.Unlock()
+		return nil
+	default:
+	}
+	close(p.closed)
+	hosts := make(map[string]*hostPool, len(p.hosts))
+	for addr, h := range p.hosts {
+		hosts[addr] = h
+	}
+	p.mu.Unlock()
+
+	<-p.done
+	for addr, h := range hosts {
+		p.locks.Lock(addr)
+		for _, ic := range h.idle {
+			ic.c.Close()
+			h.open--
+		}
+		h.idle = nil
+		p.locks.Unlock(addr)
+	}
+	return nil
+}
+
+func (p *ConnPool) host(addr string) (*hostPool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	select {
+	case <-p.closed:
+		return nil, ErrPoolClosed
+	default:
+	}
+
+	h, ok := p.hosts[addr]
+	if !ok {
+		h = &hostPool{}
+		p.hosts[addr] = h
+	}
+	return h, nil
+}
+
+// checkout takes the most recently used idle connection, reserves a slot
+// to dial, or queues the caller as a waiter.
+func (p *ConnPool) checkout(addr string, h *hostPool) (c net.Conn, dial bool, wait chan net.Conn) {
+	p.locks.Lock(addr)
+	defer p.locks.Unlock(addr)
+
+	now := time.Now()
+	for len(h.idle) > 0 {
+		ic := h.idle[len(h.idle)-1]
+		h.idle = h.idle[:len(h.idle)-1]
+		if p.opts.IdleTimeout > 0 && now.Sub(ic.since) >= p.opts.IdleTimeout {
+			ic.c.Close()
+			h.open--
+			continue
+		}
+		return ic.c, false, nil
+	}
+
+	if p.opts.MaxOpen <= 0 || h.open < p.opts.MaxOpen {
+		h.open++
+		return nil, true, nil
+	}
+
+	wait = make(chan net.Conn, 1)
+	h.waiters = append(h.waiters, wait)
+	return nil, false, wait
+}
+
+func (p *ConnPool) cancelWait(addr string, h *hostPool, wait chan net.Conn) {
+	p.locks.Lock(addr)
+	defer p.locks.Unlock(addr)
+
+	if i := slices.Index(h.waiters, wait); i >= 0 {
+		h.waiters = slices.Delete(h.waiters, i, i+1)
+		return
+	}
+
+	// already served, pass it on
+	if c := <-wait; c != nil {
+		p.putLocked(h, c)
+	} else {
+		p.releaseLocked(h)
+	}
+}
+
+// putLocked returns c to a waiter or the idle list, or closes it.
+func (p *ConnPool) putLocked(h *hostPool, c net.Conn) {
+	if len(h.waiters) > 0 {
+		wait := h.waiters[0]
+		h.waiters = h.waiters[1:]
+		wait <- c
+		return
+	}
+
+	select {
+	case <-p.closed:
+	default:
+		if len(h.idle) < p.opts.MaxIdle {
+			h.idle = append(h.idle, idleConn{c, time.Now()})
+			return
+		}
+	}
+
+	c.Close()
+	h.open--
+}
+
+// releaseLocked gives up a slot of a closed connection, to a waiter if any.
+func (p *ConnPool) releaseLocked(h *hostPool) {
+	if len(h.waiters) > 0 {
+		wait := h.waiters[0]
+		h.waiters = h.waiters[1:]
+		wait <- nil
+		return
+	}
+	h.open--
+}
+
+func (p *ConnPool) evictLoop() {
+	defer close(p.done)
+
+	ticker := time.NewTicker(p.opts.IdleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.closed:
+			return
+		case <-ticker.C:
+		}
+
+		p.mu.Lock()
+		addrs := make([]string, 0, len(p.hosts))
+		hosts := make([]*hostPool, 0, len(p.hosts))
+		for addr, h := range p.hosts {
+			addrs = append(addrs, addr)
+			hosts = append(hosts, h)
+		}
+		p.mu.Unlock()
+
+		now := time.Now()
+		for i, addr := range addrs {
+			h := hosts[i]
+			p.locks.Lock(addr)
+			// the oldest connections are at the front
+			n := 0
+			for n < len(h.idle) && now.Sub(h.idle[n].since) >= p.opts.IdleTimeout {
+				h.idle[n].c.Close()
+				n++
+			}
+			h.idle = slices.Delete(h.idle, 0, n)
+			for range n {
+				p.releaseLocked(h)
+			}
+			p.locks.Unlock(addr)
+		}
+	}
+}
+
+// PooledConn is a connection checked out of a ConnPool. Close returns it
+// to the pool, Discard closes it for good.
+type PooledConn struct {
+	net.Conn
+	pool *ConnPool
+	addr string
+	host *hostPool
+	once sync.Once
+}
+
+func (pc *PooledConn) Close() error {
+	pc.once.Do(func() {
+		pc.pool.locks.Lock(pc.addr)
+		defer pc.pool.locks.Unlock(pc.addr)
+		pc.pool.putLocked(pc.host, pc.Conn)
+	})
+	return nil
+}
+
+// Discard closes a connection that is broken or in an unknown state.
+func (pc *PooledConn) Discard() error {
+	err := net.ErrClosed
+	pc.once.Do(func() {
+		err = pc.Conn.Close()
+		pc.pool.locks.Lock(pc.addr)
+		defer pc.pool.locks.Unlock(pc.addr)
+		pc.pool.releaseLocked(pc.host)
+	})
+	return err
+}
+
+func (pc *PooledConn) UnwrapConn() net.Conn {
+	return pc.Conn
+}
+
+// checkConnDeadline reads with a short deadline. A timeout means the peer
+// is still there and silent.
+func checkConnDeadline(c net.Conn) error {
+	if err := c.SetReadDeadline(time.Now().Add(time.Millisecond)); err != nil {
+		return err
+	}
+	defer c.SetReadDeadline(time.Time{})
+
+	var b [1]byte
+	_, err := c.Read(b[:])
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil
+	}
+	if err == nil {
+		return errors.New("unexpected data on idle connection")
+	}
+	return err
+}
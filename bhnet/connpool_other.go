@@ -0,0 +1,9 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package bhnet
+
+import "net"
+
+func checkConnAlive(c net.Conn) error {
+	return checkConnDeadline(c)
+}
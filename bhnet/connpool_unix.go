@@ -0,0 +1,45 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package bhnet
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+)
+
+// checkConnAlive peeks at the socket without blocking. Nothing to read
+// means alive, EOF or unread data means the connection can't be reused.
+func checkConnAlive(c net.Conn) error {
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return checkConnDeadline(c)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var (
+		n       int
+		peekErr error
+		buf     [1]byte
+	)
+	err = raw.Read(func(fd uintptr) bool {
+		n, _, peekErr = syscall.Recvfrom(int(fd), buf[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		return true
+	})
+	switch {
+	case err != nil:
+		return err
+	case errors.Is(peekErr, syscall.EAGAIN) || errors.Is(peekErr, syscall.EWOULDBLOCK):
+		return nil
+	case peekErr != nil:
+		return peekErr
+	case n == 0:
+		return io.EOF
+	default:
+		return errors.New("unexpected data on idle connection")
+	}
+}
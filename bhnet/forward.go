@@ -0,0 +1,420 @@
+package bhnet
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buhuang1002/bh-go-tools/bhrunner"
+)
+
+const defaultUDPIdleTimeout = time.Minute
+
+type ForwarderOptions struct {
+	// Network is "tcp", "tcp4", "tcp6", "udp", "udp4" or "udp6".
+	Network string
+	Listen  string
+	Target  string
+	// MaxConns limits concurrent connections, or UDP client sessions.
+	// Connections beyond it are refused. Zero means unlimited.
+	MaxConns int
+	// IdleTimeout closes connections without traffic in either direction.
+	// Zero disables it for TCP and means one minute for UDP.
+	IdleTimeout time.Duration
+	DialTimeout time.Duration
+	// OnClose receives the accounting of every finished connection.
+	OnClose func(ForwardStats)
+}
+
+// ForwardStats is the accounting of one forwarded connection. BytesIn
+// flows from the client to the target, BytesOut back.
+type ForwardStats struct {
+	Client   net.Addr
+	Started  time.Time
+	Duration time.Duration
+	BytesIn  int64
+	BytesOut int64
+}
+
+// Forwarder relays connections from a local address to a target. It runs
+// as a task of a bhrunner.GroupRunner that owns every relayed connection.
+type Forwarder struct {
+	opts   ForwarderOptions
+	runner *bhrunner.GroupRunner
+	ln     net.Listener
+	pc     net.PacketConn
+
+	mu       sync.Mutex
+	conns    map[*forwardConn]struct{}
+	sessions map[string]*forwardConn
+	draining bool
+	wg       sync.WaitGroup
+	refused  atomic.Int64
+}
+
+type forwardConn struct {
+	client   net.Addr
+	started  time.Time
+	last     atomic.Int64
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+	closing  sync.Once
+	close    func()
+	upstream net.Conn
+}
+
+func (fc *forwardConn) touch() {
+	fc.last.Store(time.Now().UnixNano())
+}
+
+func (fc *forwardConn) idle() time.Duration {
+	return time.Since(time.Unix(0, fc.last.Load()))
+}
+
+func (fc *forwardConn) stats() ForwardStats {
+	return ForwardStats{
+		Client:   fc.client,
+		Started:  fc.started,
+		Duration: time.Since(fc.started),
+		BytesIn:  fc.bytesIn.Load(),
+		BytesOut: fc.bytesOut.Load(),
+	}
+}
+
+// NewForwarder binds the listen address right away, so Addr is usable
+// before Start.
+func NewForwarder(opts ForwarderOptions) (*Forwarder, error) {
+	f := &Forwarder{
+		opts:     opts,
+		runner:   bhrunner.NewGroupRunner(),
+		conns:    map[*forwardConn]struct{}{},
+		sessions: map[string]*forwardConn{},
+	}
+
+	var err error
+	switch opts.Network {
+	case "tcp", "tcp4", "tcp6":
+		f.ln, err = net.Listen(opts.Network, opts.Listen)
+	case "udp", "udp4", "udp6":
+		if f.opts.IdleTimeout <= 0 {
+			f.opts.IdleTimeout = defaultUDPIdleTimeout
+		}
+		f.pc, err = net.ListenPacket(opts.Network, opts.Listen)
+	default:
+		err = net.UnknownNetworkError(opts.Network)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *Forwarder) Addr() net.Addr {
+	if f.ln != nil {
+		return f.ln.Addr()
+	}
+	return f.pc.LocalAddr()
+}
+
+// Start runs the forwarder until Stop is called or ctx is done.
+func (f *Forwarder) Start(ctx context.Context) {
+	if f.ln != nil {
+		f.runner.Go(ctx, f.acceptTCP)
+	} else {
+		f.runner.Go(ctx, f.serveUDP)
+	}
+}
+
+// Stop stops accepting and lets open connections drain until ctx is done,
+// then closes whatever is left. UDP sessions never end on their own and are
+// closed right away.
+func (f *Forwarder) Stop(ctx context.Context) error {
+	f.mu.Lock()
+	f.draining = true
+	sessions := make([]*forwardConn, 0, len(f.sessions))
+	for _, fc := range f.sessions {
+		sessions = append(sessions, fc)
+	}
+	f.mu.Unlock()
+
+	if f.ln != nil {
+		f.ln.Close()
+	}
+	if f.pc != nil {
+		f.pc.Close()
+	}
+	for _, fc := range sessions {
+		fc.closing.Do(fc.close)
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		f.wg.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	// connections left close their sockets once the task is cancelled
+	if stopErr := f.runner.Stop(context.Background()); err == nil {
+		err = stopErr
+	}
+	return err
+}
+
+// Connections returns the accounting of the open connections.
+func (f *Forwarder) Connections() []ForwardStats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	stats := make([]ForwardStats, 0, len(f.conns))
+	for fc := range f.conns {
+		stats = append(stats, fc.stats())
+	}
+	return stats
+}
+
+// Refused returns how many connections were turned away by MaxConns.
+func (f *Forwarder) Refused() int64 {
+	return f.refused.Load()
+}
+
+// track registers fc unless the forwarder is draining or full.
+func (f *Forwarder) track(fc *forwardConn) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.draining || (f.opts.MaxConns > 0 && len(f.conns) >= f.opts.MaxConns) {
+		f.refused.Add(1)
+		return false
+	}
+
+	f.conns[fc] = struct{}{}
+	f.wg.Add(1)
+	return true
+}
+
+func (f *Forwarder) untrack(fc *forwardConn) {
+	f.mu.Lock()
+	delete(f.conns, fc)
+	if f.pc != nil {
+		delete(f.sessions, fc.client.String())
+	}
+	f.mu.Unlock()
+
+	if f.opts.OnClose != nil {
+		f.opts.OnClose(fc.stats())
+	}
+	f.wg.Done()
+}
+
+func (f *Forwarder) acceptTCP(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		f.ln.Close()
+	}()
+
+	defer f.wg.Wait()
+
+	for {
+		c, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		fc := &forwardConn{client: c.RemoteAddr(), started: time.Now()}
+		fc.touch()
+		if !f.track(fc) {
+			c.Close()
+			continue
+		}
+
+		go func() {
+			defer f.untrack(fc)
+			f.forwardTCP(ctx, fc, c)
+		}()
+	}
+}
+
+func (f *Forwarder) forwardTCP(ctx context.Context, fc *forwardConn, c net.Conn) {
+	defer c.Close()
+
+	dialer := net.Dialer{Timeout: f.opts.DialTimeout}
+	upstream, err := dialer.DialContext(ctx, f.opts.Network, f.opts.Target)
+	if err != nil {
+		return
+	}
+	defer upstream.Close()
+
+	fc.close = func() {
+		c.Close()
+		upstream.Close()
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go f.watch(ctx, fc, done)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		relay(upstream, c, fc, &fc.bytesIn)
+	}()
+	go func() {
+		defer wg.Done()
+		relay(c, upstream, fc, &fc.bytesOut)
+	}()
+	wg.Wait()
+}
+
+// watch closes fc once ctx is done or it has been idle for too long.
+func (f *Forwarder) watch(ctx context.Context, fc *forwardConn, done <-chan struct{}) {
+	var tick <-chan time.Time
+	if f.opts.IdleTimeout > 0 {
+		ticker := time.NewTicker(f.opts.IdleTimeout / 4)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+			fc.closing.Do(fc.close)
+			return
+		case <-tick:
+			if fc.idle() >= f.opts.IdleTimeout {
+				fc.closing.Do(fc.close)
+				return
+			}
+		}
+	}
+}
+
+// relay copies src to dst and half-closes dst at EOF.
+func relay(dst, src net.Conn, fc *forwardConn, counter *atomic.Int64) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			fc.touch()
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				break
+			}
+			counter.Add(int64(n))
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	} else {
+		dst.Close()
+	}
+}
+
+func (f *Forwarder) serveUDP(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		f.pc.Close()
+	}()
+
+	defer f.wg.Wait()
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := f.pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		fc, err := f.udpSession(ctx, addr)
+		if err != nil || fc == nil {
+			continue
+		}
+
+		fc.touch()
+		if _, err := fc.upstream.Write(buf[:n]); err == nil {
+			fc.bytesIn.Add(int64(n))
+		}
+	}
+}
+
+// udpSession returns the session of the client at addr, creating it if needed.
+// A nil session means the packet is dropped.
+func (f *Forwarder) udpSession(ctx context.Context, addr net.Addr) (*forwardConn, error) {
+	f.mu.Lock()
+	fc, ok := f.sessions[addr.String()]
+	f.mu.Unlock()
+	if ok {
+		return fc, nil
+	}
+
+	fc = &forwardConn{client: addr, started: time.Now()}
+	fc.touch()
+	if !f.track(fc) {
+		return nil, nil
+	}
+
+	dialer := net.Dialer{Timeout: f.opts.DialTimeout}
+	upstream, err := dialer.DialContext(ctx, f.opts.Network, f.opts.Target)
+	if err != nil {
+		f.untrack(fc)
+		return nil, err
+	}
+	fc.upstream = upstream
+	fc.close = func() {
+		upstream.Close()
+	}
+
+	f.mu.Lock()
+	f.sessions[addr.String()] = fc
+	draining := f.draining
+	f.mu.Unlock()
+	if draining {
+		// Stop missed it
+		fc.closing.Do(fc.close)
+	}
+
+	go func() {
+		defer f.untrack(fc)
+		defer upstream.Close()
+
+		done := make(chan struct{})
+		defer close(done)
+		go f.watch(ctx, fc, done)
+
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := upstream.Read(buf)
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) {
+					return
+				}
+				continue
+			}
+
+			fc.touch()
+			if _, err := f.pc.WriteTo(buf[:n], addr); err == nil {
+				fc.bytesOut.Add(int64(n))
+			}
+		}
+	}()
+	return fc, nil
+}
@@ -0,0 +1,135 @@
+package bhnet
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+)
+
+// InterfaceAddr is an address assigned to an interface.
+type InterfaceAddr struct {
+	Prefix   netip.Prefix
+	Category IPCategory
+}
+
+// Addr returns the address without its prefix length.
+func (ia InterfaceAddr) Addr() netip.Addr {
+	return ia.Prefix.Addr()
+}
+
+// Interface is a snapshot of a network interface.
+type Interface struct {
+	Index        int
+	Name         string
+	MTU          int
+	Flags        net.Flags
+	HardwareAddr net.HardwareAddr
+	Addrs        []InterfaceAddr
+}
+
+func (i Interface) IsUp() bool {
+	return i.Flags&net.FlagUp != 0
+}
+
+func (i Interface) IsRunning() bool {
+	return i.Flags&net.FlagRunning != 0
+}
+
+func (i Interface) IsLoopback() bool {
+	return i.Flags&net.FlagLoopback != 0
+}
+
+// Interfaces returns every network interface together with its addresses.
+func Interfaces() ([]Interface, error) {
+	ifis, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	ifs := make([]Interface, 0, len(ifis))
+	for i := range ifis {
+		iface, err := newInterface(&ifis[i])
+		if err != nil {
+			return nil, err
+		}
+		ifs = append(ifs, iface)
+	}
+	return ifs, nil
+}
+
+func InterfaceByName(name string) (Interface, error) {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return Interface{}, err
+	}
+	return newInterface(ifi)
+}
+
+func newInterface(ifi *net.Interface) (Interface, error) {
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return Interface{}, err
+	}
+
+	iface := Interface{
+		Index:        ifi.Index,
+		Name:         ifi.Name,
+		MTU:          ifi.MTU,
+		Flags:        ifi.Flags,
+		HardwareAddr: ifi.HardwareAddr,
+	}
+
+	for _, address := range addrs {
+		ipnet, ok := address.(*net.IPNet)
+		if !ok {
+			continue
+		}
+
+		addr, ok := netip.AddrFromSlice(ipnet.IP)
+		if !ok {
+			continue
+		}
+		addr = addr.Unmap()
+
+		ones, _ := ipnet.Mask.Size()
+		if addr.Is4() && ones > 32 {
+			ones -= 96
+		}
+
+		iface.Addrs = append(iface.Addrs, InterfaceAddr{
+			Prefix:   netip.PrefixFrom(addr, ones),
+			Category: Classify(addr),
+		})
+	}
+	return iface, nil
+}
+
+// OutboundAddr returns the local address the kernel would pick to reach dst.
+// It connects a UDP socket, which only consults the routing table, so no
+// packet is sent.
+func OutboundAddr(dst netip.Addr) (netip.Addr, error) {
+	if !dst.IsValid() {
+		return netip.Addr{}, errors.New("invalid destination address")
+	}
+
+	conn, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(netip.AddrPortFrom(dst, 9)))
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).AddrPort().Addr().Unmap(), nil
+}
+
+var (
+	defaultRouteProbe4 = netip.MustParseAddr("8.8.8.8")
+	defaultRouteProbe6 = netip.MustParseAddr("2001:4860:4860::8888")
+)
+
+// DefaultOutboundAddr returns the local address of the default route.
+func DefaultOutboundAddr(ipv6 bool) (netip.Addr, error) {
+	if ipv6 {
+		return OutboundAddr(defaultRouteProbe6)
+	}
+	return OutboundAddr(defaultRouteProbe4)
+}
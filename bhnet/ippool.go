@@ -0,0 +1,334 @@
+package bhnet
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+var (
+	ErrPoolExhausted = errors.New("ip pool exhausted")
+	ErrAddrInUse     = errors.New("address is already leased")
+	ErrAddrNotLeased = errors.New("address is not leased")
+)
+
+type IPPoolOptions struct {
+	// Reserved addresses are never handed out.
+	Reserved []netip.Addr
+	// ReserveGateway keeps the first host address of every prefix free.
+	ReserveGateway bool
+}
+
+// Lease is an address handed out by an IPPool. A zero Expires never expires.
+type Lease struct {
+	Addr    netip.Addr
+	Owner   string
+	Expires time.Time
+}
+
+func (l Lease) expired(now time.Time) bool {
+	return !l.Expires.IsZero() && !now.Before(l.Expires)
+}
+
+// IPPool allocates addresses from a list of prefixes. The network address,
+// the IPv4 broadcast address and, optionally, the gateway are excluded.
+// Expired leases are reclaimed lazily.
+type IPPool struct {
+	mu       sync.Mutex
+	prefixes []netip.Prefix
+	opts     IPPoolOptions
+	reserved map[netip.Addr]struct{}
+	leases   map[netip.Addr]Lease
+	owners   map[string]netip.Addr
+	cursor   netip.Addr
+}
+
+type ipPoolState struct {
+	Prefixes       []netip.Prefix `json:"prefixes"`
+	Reserved       []netip.Addr   `json:"reserved,omitempty"`
+	ReserveGateway bool           `json:"reserve_gateway,omitempty"`
+	Leases         []leaseState   `json:"leases"`
+}
+
+type leaseState struct {
+	Addr    netip.Addr `json:"addr"`
+	Owner   string     `json:"owner,omitempty"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+func NewIPPool(prefixes []netip.Prefix, opts IPPoolOptions) (*IPPool, error) {
+	if len(prefixes) == 0 {
+		return nil, errors.New("ip pool needs at least one prefix")
+	}
+
+	p := &IPPool{
+		opts:     opts,
+		reserved: map[netip.Addr]struct{}{},
+		leases:   map[netip.Addr]Lease{},
+		owners:   map[string]netip.Addr{},
+	}
+
+	for _, prefix := range prefixes {
+		if !prefix.IsValid() {
+			return nil, fmt.Errorf("invalid prefix %s", prefix)
+		}
+		prefix = prefix.Masked()
+		p.prefixes = append(p.prefixes, prefix)
+
+		for _, addr := range reservedAddrs(prefix, opts.ReserveGateway) {
+			p.reserved[addr] = struct{}{}
+		}
+	}
+	for _, addr := range opts.Reserved {
+		p.reserved[addr.Unmap()] = struct{}{}
+	}
+
+	return p, nil
+}
+
+// RestoreIPPool recreates a pool from a snapshot taken with MarshalJSON.
+func RestoreIPPool(data []byte) (*IPPool, error) {
+	var state ipPoolState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+
+	p, err := NewIPPool(state.Prefixes, IPPoolOptions{
+		Reserved:       state.Reserved,
+		ReserveGateway: state.ReserveGateway,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ls := range state.Leases {
+		l := Lease{Addr: ls.Addr.Unmap(), Owner: ls.Owner}
+		if ls.Expires != nil {
+			l.Expires = *ls.Expires
+		}
+
+		if !p.allocatable(l.Addr) {
+			return nil, fmt.Errorf("lease %s is outside of the pool", l.Addr)
+		}
+		p.leases[l.Addr] = l
+		if l.Owner != "" {
+			p.owners[l.Owner] = l.Addr
+		}
+	}
+	return p, nil
+}
+
+func reservedAddrs(prefix netip.Prefix, gateway bool) []netip.Addr {
+	// /31, /32, /127 and /128 have no room for reservations
+	if prefix.Addr().BitLen()-prefix.Bits() < 2 {
+		return nil
+	}
+
+	addrs := []netip.Addr{prefix.Addr()}
+	if prefix.Addr().Is4() {
+		addrs = append(addrs, lastAddr(prefix))
+	}
+	if gateway {
+		addrs = append(addrs, prefix.Addr().Next())
+	}
+	return addrs
+}
+
+// Allocate leases a free address to owner for ttl, zero meaning forever.
+// An owner that already holds a lease gets it back, renewed.
+func (p *IPPool) Allocate(owner string, ttl time.Duration) (Lease, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if owner != "" {
+		if addr, ok := p.owners[owner]; ok {
+			if l := p.leases[addr]; !l.expired(now) {
+				return p.lease(addr, owner, ttl, now), nil
+			}
+		}
+	}
+
+	addr, ok := p.findFree(now)
+	if !ok {
+		return Lease{}, ErrPoolExhausted
+	}
+	p.cursor = addr
+	return p.lease(addr, owner, ttl, now), nil
+}
+
+// AllocateAddr leases the given address.
+func (p *IPPool) AllocateAddr(addr netip.Addr, owner string, ttl time.Duration) (Lease, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	addr = addr.Unmap()
+	if !p.allocatable(addr) {
+		return Lease{}, fmt.Errorf("%s is not allocatable from the pool", addr)
+	}
+
+	now := time.Now()
+	if l, ok := p.leases[addr]; ok && !l.expired(now) && l.Owner != owner {
+		return Lease{}, fmt.Errorf("%w: %s", ErrAddrInUse, addr)
+	}
+	return p.lease(addr, owner, ttl, now), nil
+}
+
+// Renew extends the lease of addr by ttl from now.
+func (p *IPPool) Renew(addr netip.Addr, ttl time.Duration) (Lease, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	addr = addr.Unmap()
+	now := time.Now()
+	l, ok := p.leases[addr]
+	if !ok || l.expired(now) {
+		return Lease{}, fmt.Errorf("%w: %s", ErrAddrNotLeased, addr)
+	}
+	return p.lease(addr, l.Owner, ttl, now), nil
+}
+
+func (p *IPPool) Release(addr netip.Addr) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	addr = addr.Unmap()
+	l, ok := p.leases[addr]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrAddrNotLeased, addr)
+	}
+	p.drop(l)
+	return nil
+}
+
+// Lookup returns the active lease of addr.
+func (p *IPPool) Lookup(addr netip.Addr) (Lease, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	l, ok := p.leases[addr.Unmap()]
+	if !ok || l.expired(time.Now()) {
+		return Lease{}, false
+	}
+	return l, true
+}
+
+// Leases returns every active lease ordered by address.
+func (p *IPPool) Leases() []Lease {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.activeLeases(time.Now())
+}
+
+// MarshalJSON snapshots the configuration and the active leases.
+func (p *IPPool) MarshalJSON() ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	state := ipPoolState{
+		Prefixes:       p.prefixes,
+		Reserved:       p.opts.Reserved,
+		ReserveGateway: p.opts.ReserveGateway,
+		Leases:         []leaseState{},
+	}
+	for _, l := range p.activeLeases(time.Now()) {
+		ls := leaseState{Addr: l.Addr, Owner: l.Owner}
+		if !l.Expires.IsZero() {
+			ls.Expires = &l.Expires
+		}
+		state.Leases = append(state.Leases, ls)
+	}
+	return json.Marshal(state)
+}
+
+func (p *IPPool) activeLeases(now time.Time) []Lease {
+	leases := make([]Lease, 0, len(p.leases))
+	for _, l := range p.leases {
+		if !l.expired(now) {
+			leases = append(leases, l)
+		}
+	}
+	slices.SortFunc(leases, func(a, b Lease) int {
+		return a.Addr.Compare(b.Addr)
+	})
+	return leases
+}
+
+func (p *IPPool) lease(addr netip.Addr, owner string, ttl time.Duration, now time.Time) Lease {
+	if old, ok := p.leases[addr]; ok {
+		p.drop(old)
+	}
+	if prev, ok := p.owners[owner]; ok && owner != "" && prev != addr {
+		p.drop(p.leases[prev])
+	}
+
+	l := Lease{Addr: addr, Owner: owner}
+	if ttl > 0 {
+		l.Expires = now.Add(ttl)
+	}
+
+	p.leases[addr] = l
+	if owner != "" {
+		p.owners[owner] = addr
+	}
+	return l
+}
+
+func (p *IPPool) drop(l Lease) {
+	delete(p.leases, l.Addr)
+	if l.Owner != "" && p.owners[l.Owner] == l.Addr {
+		delete(p.owners, l.Owner)
+	}
+}
+
+func (p *IPPool) allocatable(addr netip.Addr) bool {
+	if _, ok := p.reserved[addr]; ok {
+		return false
+	}
+	for _, prefix := range p.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// findFree scans the prefixes once, starting after the last allocation.
+func (p *IPPool) findFree(now time.Time) (netip.Addr, bool) {
+	start := 0
+	for i, prefix := range p.prefixes {
+		if prefix.Contains(p.cursor) {
+			start = i
+			break
+		}
+	}
+
+	for n := 0; n <= len(p.prefixes); n++ {
+		prefix := p.prefixes[(start+n)%len(p.prefixes)]
+
+		addr := prefix.Addr()
+		stop := netip.Addr{}
+		if n == 0 && prefix.Contains(p.cursor) {
+			addr = p.cursor.Next()
+		}
+		if n == len(p.prefixes) {
+			// second pass over the first prefix, up to the cursor
+			stop = p.cursor.Next()
+		}
+
+		for ; addr.IsValid() && prefix.Contains(addr) && addr != stop; addr = addr.Next() {
+			if _, ok := p.reserved[addr]; ok {
+				continue
+			}
+			if l, ok := p.leases[addr]; ok && !l.expired(now) {
+				continue
+			}
+			return addr, true
+		}
+	}
+	return netip.Addr{}, false
+}
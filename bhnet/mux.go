@@ -0,0 +1,284 @@
+package bhnet
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/buhuang1002/bh-go-tools/bhio"
+)
+
+var ErrMuxClosed = errors.New("mux closed")
+
+const (
+	muxRequest byte = iota + 1
+	muxResponse
+	muxError
+	muxCancel
+)
+
+const muxHeaderSize = 5
+
+// MuxHandler answers a request of the peer. ctx is cancelled when the
+// caller gives up or the Mux is closed.
+type MuxHandler func(ctx context.Context, req []byte) ([]byte, error)
+
+// RemoteError is an error returned by the peer's handler.
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return "remote: " + e.Message
+}
+
+type muxReply struct {
+	body []byte
+	err  error
+}
+
+// Mux runs concurrent requests and responses over one connection. Every
+// frame starts with its kind and a stream ID, so both ends can call the
+// other at the same time.
+type Mux struct {
+	conn    net.Conn
+	fr      *bhio.FrameReader
+	fw      *bhio.FrameWriter
+	handler MuxHandler
+	// requesting is held while a request is written
+	requesting chan struct{}
+
+	mu       sync.Mutex
+	nextID   uint32
+	pending  map[uint32]chan muxReply
+	handling map[uint32]context.CancelFunc
+	err      error
+
+	ctx      context.Context
+	cancel   context.CancelFunc
+	handlers sync.WaitGroup
+	done     chan struct{}
+}
+
+// NewMux starts serving conn. handler may be nil for a Mux that only calls.
+func NewMux(conn net.Conn, handler MuxHandler, opts bhio.FrameOptions) *Mux {
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &Mux{
+		conn:       conn,
+		fr:         bhio.NewFrameReader(conn, opts),
+		fw:         bhio.NewFrameWriter(conn, opts),
+		handler:    handler,
+		pending:    map[uint32]chan muxReply{},
+		handling:   map[uint32]context.CancelFunc{},
+		requesting: make(chan struct{}, 1),
+		ctx:        ctx,
+		cancel:     cancel,
+		done:       make(chan struct{}),
+	}
+	go m.readLoop()
+	return m
+}
+
+// Call sends req and waits for the response of the peer's handler. A call
+// that gives up while its request is being written returns at once, the
+// write completes in the background to keep the stream intact.
+func (m *Mux) Call(ctx context.Context, req []byte) ([]byte, error) {
+	reply := make(chan muxReply, 1)
+
+	m.mu.Lock()
+	if m.err != nil {
+		err := m.err
+		m.mu.Unlock()
+		return nil, err
+	}
+	m.nextID++
+	id := m.nextID
+	m.pending[id] = reply
+	m.mu.Unlock()
+
+	// requests queue here rather than on the connection, so that a call
+	// can give up before anything is written
+	select {
+	case m.requesting <- struct{}{}:
+	case <-ctx.Done():
+		m.forget(id)
+		return nil, ctx.Err()
+	}
+
+	written := make(chan error, 1)
+	go func() {
+		err := m.send(muxRequest, id, req)
+		<-m.requesting
+		written <- err
+	}()
+
+	select {
+	case err := <-written:
+		if err != nil {
+			m.forget(id)
+			return nil, err
+		}
+	case <-ctx.Done():
+		m.forget(id)
+		go func() {
+			if <-written == nil {
+				m.send(muxCancel, id, nil)
+			}
+		}()
+		return nil, ctx.Err()
+	}
+
+	select {
+	case r := <-reply:
+		return r.body, r.err
+	case <-ctx.Done():
+		if m.forget(id) {
+			// let the peer stop working on it, errors don't matter anymore
+			go m.send(muxCancel, id, nil)
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// Done is closed once the connection is gone.
+func (m *Mux) Done() <-chan struct{} {
+	return m.done
+}
+
+// Err returns why the Mux stopped, ErrMuxClosed after Close.
+func (m *Mux) Err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+// Close closes the connection, fails pending calls and waits for the
+// running handlers to return.
+func (m *Mux) Close() error {
+	m.fail(ErrMuxClosed)
+	err := m.conn.Close()
+	<-m.done
+	m.handlers.Wait()
+	return err
+}
+
+func (m *Mux) forget(id uint32) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.pending[id]
+	delete(m.pending, id)
+	return ok
+}
+
+func (m *Mux) send(kind byte, id uint32, body []byte) error {
+	frame := make([]byte, muxHeaderSize, muxHeaderSize+len(body))
+	frame[0] = kind
+	binary.BigEndian.PutUint32(frame[1:], id)
+	return m.fw.WriteFrame(append(frame, body...))
+}
+
+// fail records the first error and fails every pending call.
+func (m *Mux) fail(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return
+	}
+	m.err = err
+	for id, reply := range m.pending {
+		reply <- muxReply{err: err}
+		delete(m.pending, id)
+	}
+	m.cancel()
+}
+
+func (m *Mux) readLoop() {
+	defer close(m.done)
+
+	for {
+		frame, err := m.fr.ReadFrame()
+		if err != nil {
+			m.fail(fmt.Errorf("%w: %w", ErrMuxClosed, err))
+			m.conn.Close()
+			return
+		}
+		if len(frame) < muxHeaderSize {
+			m.fail(fmt.Errorf("%w: short frame", ErrMuxClosed))
+			m.conn.Close()
+			return
+		}
+
+		kind, id, body := frame[0], binary.BigEndian.Uint32(frame[1:]), frame[muxHeaderSize:]
+		switch kind {
+		case muxRequest:
+			m.handle(id, body)
+		case muxCancel:
+			m.mu.Lock()
+			if cancel, ok := m.handling[id]; ok {
+				cancel()
+			}
+			m.mu.Unlock()
+		case muxResponse, muxError:
+			m.mu.Lock()
+			reply, ok := m.pending[id]
+			delete(m.pending, id)
+			m.mu.Unlock()
+			if !ok {
+				// the call was cancelled
+				continue
+			}
+
+			if kind == muxError {
+				reply <- muxReply{err: &RemoteError{Message: string(body)}}
+			} else {
+				reply <- muxReply{body: body}
+			}
+		}
+	}
+}
+
+// handle never writes from the read loop, on a synchronous connection like
+// net.Pipe both ends would block writing.
+func (m *Mux) handle(id uint32, req []byte) {
+	handler := m.handler
+	if handler == nil {
+		handler = func(context.Context, []byte) ([]byte, error) {
+			return nil, errors.New("no handler")
+		}
+	}
+
+	ctx, cancel := context.WithCancel(m.ctx)
+	m.mu.Lock()
+	m.handling[id] = cancel
+	m.mu.Unlock()
+
+	m.handlers.Add(1)
+	go func() {
+		defer m.handlers.Done()
+		defer func() {
+			m.mu.Lock()
+			delete(m.handling, id)
+			m.mu.Unlock()
+			cancel()
+		}()
+
+		resp, err := handler(ctx, req)
+		if ctx.Err() != nil {
+			// nobody waits for the answer
+			return
+		}
+		if err == nil {
+			err = m.send(muxResponse, id, resp)
+		}
+		if err != nil {
+			// the caller waits for an answer, e.g. after ErrFrameTooLarge
+			if m.send(muxError, id, []byte(err.Error())) != nil {
+				m.send(muxError, id, []byte("response could not be sent"))
+			}
+		}
+	}()
+}
@@ -0,0 +1,197 @@
+package bhnet
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var ErrNoFreePort = errors.New("no free port")
+
+// handedPorts remembers ports released to callers, so this process never
+// hands out the same port twice while the caller is still binding it.
+var handedPorts = struct {
+	sync.Mutex
+	m map[string]struct{}
+}{m: map[string]struct{}{}}
+
+func handedKey(network string, port int) string {
+	return strings.TrimRight(network, "46") + "/" + strconv.Itoa(port)
+}
+
+func isHanded(network string, port int) bool {
+	handedPorts.Lock()
+	defer handedPorts.Unlock()
+	_, ok := handedPorts.m[handedKey(network, port)]
+	return ok
+}
+
+func markHanded(network string, port int) {
+	handedPorts.Lock()
+	defer handedPorts.Unlock()
+	handedPorts.m[handedKey(network, port)] = struct{}{}
+}
+
+// PortReservation keeps a port bound until it is handed off, either as the
+// bound listener itself or by releasing the port number.
+type PortReservation struct {
+	Network string
+	Port    int
+
+	mu sync.Mutex
+	ln net.Listener
+	pc net.PacketConn
+}
+
+// ReservePort binds a free port of network ("tcp", "tcp4", "tcp6", "udp",
+// "udp4" or "udp6") on host. With min and max zero the kernel picks the
+// port, otherwise ports in min..max are tried in random order.
+func ReservePort(network, host string, min, max int) (*PortReservation, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6":
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+	if min < 0 || max > 65535 || min > max {
+		return nil, fmt.Errorf("invalid port range %d-%d", min, max)
+	}
+
+	if min == 0 && max == 0 {
+		// the kernel may return a port we already handed out, retry a few times
+		for i := 0; i < 16; i++ {
+			r, err := bindPort(network, host, 0)
+			if err != nil {
+				return nil, err
+			}
+			if !isHanded(network, r.Port) {
+				return r, nil
+			}
+			r.close()
+		}
+		return nil, ErrNoFreePort
+	}
+
+	ports := make([]int, 0, max-min+1)
+	for port := min; port <= max; port++ {
+		if port != 0 {
+			ports = append(ports, port)
+		}
+	}
+	rand.Shuffle(len(ports), func(i, j int) {
+		ports[i], ports[j] = ports[j], ports[i]
+	})
+
+	for _, port := range ports {
+		if isHanded(network, port) {
+			continue
+		}
+
+		// ports in use fail to bind, just move on
+		if r, err := bindPort(network, host, port); err == nil {
+			return r, nil
+		}
+	}
+	return nil, fmt.Errorf("%w in %d-%d", ErrNoFreePort, min, max)
+}
+
+func bindPort(network, host string, port int) (*PortReservation, error) {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	r := &PortReservation{Network: network}
+
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		ln, err := net.Listen(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		r.ln = ln
+		r.Port = ln.Addr().(*net.TCPAddr).Port
+	case "udp", "udp4", "udp6":
+		pc, err := net.ListenPacket(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		r.pc = pc
+		r.Port = pc.LocalAddr().(*net.UDPAddr).Port
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+	return r, nil
+}
+
+// Listener hands off the bound TCP listener. The reservation is done afterwards.
+func (r *PortReservation) Listener() (net.Listener, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.ln == nil {
+		return nil, errors.New("reservation holds no tcp listener")
+	}
+
+	ln := r.ln
+	r.ln = nil
+	markHanded(r.Network, r.Port)
+	return ln, nil
+}
+
+// PacketConn hands off the bound UDP socket. The reservation is done afterwards.
+func (r *PortReservation) PacketConn() (net.PacketConn, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.pc == nil {
+		return nil, errors.New("reservation holds no udp socket")
+	}
+
+	pc := r.pc
+	r.pc = nil
+	markHanded(r.Network, r.Port)
+	return pc, nil
+}
+
+// Release unbinds the port so that another program can bind Port.
+// The port is never reserved again by this process.
+func (r *PortReservation) Release() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	markHanded(r.Network, r.Port)
+	return r.close()
+}
+
+func (r *PortReservation) close() error {
+	var err error
+	if r.ln != nil {
+		err = r.ln.Close()
+		r.ln = nil
+	}
+	if r.pc != nil {
+		err = r.pc.Close()
+		r.pc = nil
+	}
+	return err
+}
+
+// FreePort returns a port number, and the function that releases it,
+// for a program that binds the port itself. The port stays bound until
+// release is called.
+func FreePort(network, host string, min, max int) (port int, release func() error, err error) {
+	r, err := ReservePort(network, host, min, max)
+	if err != nil {
+		return 0, nil, err
+	}
+	return r.Port, r.Release, nil
+}
+
+// ListenFreeTCP returns a listener on a free port in min..max.
+func ListenFreeTCP(host string, min, max int) (net.Listener, error) {
+	r, err := ReservePort("tcp", host, min, max)
+	if err != nil {
+		return nil, err
+	}
+	return r.Listener()
+}
@@ -0,0 +1,390 @@
+package bhnet
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// IPRange is the inclusive range of addresses From..To of one family.
+type IPRange struct {
+	From netip.Addr
+	To   netip.Addr
+}
+
+func (r IPRange) String() string {
+	return r.From.String() + "-" + r.To.String()
+}
+
+// Prefixes returns the minimal list of CIDRs covering exactly r.
+func (r IPRange) Prefixes() []netip.Prefix {
+	var prefixes []netip.Prefix
+	lo := r.From
+	for lo.IsValid() && lo.Compare(r.To) <= 0 {
+		for bits := 0; bits <= lo.BitLen(); bits++ {
+			p := netip.PrefixFrom(lo, bits)
+			if p.Masked().Addr() != lo || lastAddr(p).Compare(r.To) > 0 {
+				continue
+			}
+
+			prefixes = append(prefixes, p)
+			lo = lastAddr(p).Next()
+			break
+		}
+	}
+	return prefixes
+}
+
+// RangeToPrefixes returns the minimal list of CIDRs covering from..to.
+func RangeToPrefixes(from, to netip.Addr) ([]netip.Prefix, error) {
+	from, to = from.Unmap().WithZone(""), to.Unmap().WithZone("")
+	if !from.IsValid() || !to.IsValid() || from.BitLen() != to.BitLen() {
+		return nil, fmt.Errorf("invalid range %s-%s", from, to)
+	}
+	if from.Compare(to) > 0 {
+		return nil, fmt.Errorf("invalid range %s-%s: start is after end", from, to)
+	}
+	return IPRange{from, to}.Prefixes(), nil
+}
+
+func lastAddr(p netip.Prefix) netip.Addr {
+	a := p.Masked().Addr()
+	if a.Is4() {
+		b := a.As4()
+		setHostBits(b[:], p.Bits())
+		return netip.AddrFrom4(b)
+	}
+
+	b := a.As16()
+	setHostBits(b[:], p.Bits())
+	return netip.AddrFrom16(b)
+}
+
+func setHostBits(b []byte, bits int) {
+	for i := range b {
+		switch {
+		case bits >= (i+1)*8:
+		case bits <= i*8:
+			b[i] = 0xff
+		default:
+			b[i] |= 0xff >> (bits - i*8)
+		}
+	}
+}
+
+// prefixRange returns the range of p, turning IPv4-mapped prefixes into IPv4.
+func prefixRange(p netip.Prefix) IPRange {
+	a := p.Addr().WithZone("")
+	if a.Is4In6() && p.Bits() >= 96 {
+		p = netip.PrefixFrom(a.Unmap(), p.Bits()-96)
+	} else {
+		p = netip.PrefixFrom(a, p.Bits())
+	}
+
+	p = p.Masked()
+	return IPRange{p.Addr(), lastAddr(p)}
+}
+
+// PrefixSet is an immutable set of IPv4 and IPv6 addresses. Operations
+// return new sets, so a PrefixSet can be shared between goroutines.
+type PrefixSet struct {
+	ranges []IPRange
+
+	trieOnce sync.Once
+	trie4    *trieNode
+	trie6    *trieNode
+}
+
+// NewPrefixSet returns the union of prefixes.
+func NewPrefixSet(prefixes ...netip.Prefix) *PrefixSet {
+	ranges := make([]IPRange, 0, len(prefixes))
+	for _, p := range prefixes {
+		if p.IsValid() {
+			ranges = append(ranges, prefixRange(p))
+		}
+	}
+	return newPrefixSet(ranges)
+}
+
+// NewPrefixSetFromRanges returns the union of ranges.
+func NewPrefixSetFromRanges(ranges ...IPRange) (*PrefixSet, error) {
+	for _, r := range ranges {
+		if _, err := RangeToPrefixes(r.From, r.To); err != nil {
+			return nil, err
+		}
+	}
+
+	normalized := make([]IPRange, len(ranges))
+	for i, r := range ranges {
+		normalized[i] = IPRange{r.From.Unmap().WithZone(""), r.To.Unmap().WithZone("")}
+	}
+	return newPrefixSet(normalized), nil
+}
+
+// ParsePrefixSet parses a list of CIDRs, single addresses and ranges
+// written as from-to, separated by whitespace, commas or newlines.
+// Everything after a '#' on a line is a comment.
+func ParsePrefixSet(text string) (*PrefixSet, error) {
+	var ranges []IPRange
+	for _, line := range strings.Split(text, "\n") {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+
+		for _, field := range strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t' || r == '\r'
+		}) {
+			r, err := parseRange(field)
+			if err != nil {
+				return nil, err
+			}
+			ranges = append(ranges, r)
+		}
+	}
+	return newPrefixSet(ranges), nil
+}
+
+func parseRange(s string) (IPRange, error) {
+	if from, to, ok := strings.Cut(s, "-"); ok {
+		a, err := netip.ParseAddr(from)
+		if err != nil {
+			return IPRange{}, err
+		}
+		b, err := netip.ParseAddr(to)
+		if err != nil {
+			return IPRange{}, err
+		}
+		if _, err := RangeToPrefixes(a, b); err != nil {
+			return IPRange{}, err
+		}
+		return IPRange{a.Unmap().WithZone(""), b.Unmap().WithZone("")}, nil
+	}
+
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return IPRange{}, err
+		}
+		return prefixRange(p), nil
+	}
+
+	a, err := netip.ParseAddr(s)
+	if err != nil {
+		return IPRange{}, err
+	}
+	a = a.Unmap().WithZone("")
+	return IPRange{a, a}, nil
+}
+
+// newPrefixSet sorts and merges overlapping or adjacent ranges.
+func newPrefixSet(ranges []IPRange) *PrefixSet {
+	slices.SortFunc(ranges, func(a, b IPRange) int {
+		return a.From.Compare(b.From)
+	})
+
+	var merged []IPRange
+	for _, r := range ranges {
+		if n := len(merged); n > 0 {
+			last := &merged[n-1]
+			next := last.To.Next()
+			if last.To.BitLen() == r.From.BitLen() && (!next.IsValid() || r.From.Compare(next) <= 0) {
+				if r.To.Compare(last.To) > 0 {
+					last.To = r.To
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+	return &PrefixSet{ranges: merged}
+}
+
+// Ranges returns the set as sorted, non-overlapping ranges.
+func (s *PrefixSet) Ranges() []IPRange {
+	return slices.Clone(s.ranges)
+}
+
+// Prefixes returns the minimal list of CIDRs covering the set.
+func (s *PrefixSet) Prefixes() []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, r := range s.ranges {
+		prefixes = append(prefixes, r.Prefixes()...)
+	}
+	return prefixes
+}
+
+func (s *PrefixSet) IsEmpty() bool {
+	return len(s.ranges) == 0
+}
+
+func (s *PrefixSet) Equal(o *PrefixSet) bool {
+	return slices.Equal(s.ranges, o.ranges)
+}
+
+func (s *PrefixSet) Union(o *PrefixSet) *PrefixSet {
+	return newPrefixSet(append(slices.Clone(s.ranges), o.ranges...))
+}
+
+func (s *PrefixSet) Intersect(o *PrefixSet) *PrefixSet {
+	var out []IPRange
+	i, j := 0, 0
+	for i < len(s.ranges) && j < len(o.ranges) {
+		a, b := s.ranges[i], o.ranges[j]
+		from := maxAddr(a.From, b.From)
+		to := minAddr(a.To, b.To)
+		if from.BitLen() == to.BitLen() && from.Compare(to) <= 0 {
+			out = append(out, IPRange{from, to})
+		}
+
+		if a.To.Compare(b.To) < 0 {
+			i++
+		} else {
+			j++
+		}
+	}
+	return &PrefixSet{ranges: out}
+}
+
+// Difference returns the addresses of s that are not in o.
+func (s *PrefixSet) Difference(o *PrefixSet) *PrefixSet {
+	var out []IPRange
+	j := 0
+	for _, r := range s.ranges {
+		cur := r
+		for j < len(o.ranges) && o.ranges[j].To.Compare(cur.From) < 0 {
+			j++
+		}
+
+		k := j
+		for ; k < len(o.ranges) && o.ranges[k].From.Compare(cur.To) <= 0; k++ {
+			b := o.ranges[k]
+			if b.From.Compare(cur.From) > 0 {
+				out = append(out, IPRange{cur.From, b.From.Prev()})
+			}
+			if b.To.Compare(cur.To) >= 0 {
+				cur.From = netip.Addr{}
+				break
+			}
+			cur.From = b.To.Next()
+		}
+
+		if cur.From.IsValid() {
+			out = append(out, cur)
+		}
+	}
+	return &PrefixSet{ranges: out}
+}
+
+// Contains reports whether addr is in the set. Lookups walk a binary trie
+// that is built on first use.
+func (s *PrefixSet) Contains(addr netip.Addr) bool {
+	addr = addr.Unmap().WithZone("")
+	if !addr.IsValid() {
+		return false
+	}
+
+	s.trieOnce.Do(s.buildTrie)
+	if addr.Is4() {
+		b := addr.As4()
+		return s.trie4.contains(b[:])
+	}
+	b := addr.As16()
+	return s.trie6.contains(b[:])
+}
+
+// ContainsPrefix reports whether every address of p is in the set.
+func (s *PrefixSet) ContainsPrefix(p netip.Prefix) bool {
+	if !p.IsValid() {
+		return false
+	}
+
+	r := prefixRange(p)
+	i, _ := slices.BinarySearchFunc(s.ranges, r.From, func(e IPRange, a netip.Addr) int {
+		return e.To.Compare(a)
+	})
+	return i < len(s.ranges) && s.ranges[i].From.Compare(r.From) <= 0 && s.ranges[i].To.Compare(r.To) >= 0
+}
+
+// String returns the minimal CIDRs, one per line.
+func (s *PrefixSet) String() string {
+	var sb strings.Builder
+	for _, p := range s.Prefixes() {
+		sb.WriteString(p.String())
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+func (s *PrefixSet) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *PrefixSet) UnmarshalText(text []byte) error {
+	parsed, err := ParsePrefixSet(string(text))
+	if err != nil {
+		return err
+	}
+
+	s.ranges = parsed.ranges
+	s.trieOnce = sync.Once{}
+	s.trie4, s.trie6 = nil, nil
+	return nil
+}
+
+func (s *PrefixSet) buildTrie() {
+	s.trie4, s.trie6 = &trieNode{}, &trieNode{}
+	for _, p := range s.Prefixes() {
+		if p.Addr().Is4() {
+			b := p.Addr().As4()
+			s.trie4.insert(b[:], p.Bits())
+		} else {
+			b := p.Addr().As16()
+			s.trie6.insert(b[:], p.Bits())
+		}
+	}
+}
+
+type trieNode struct {
+	children [2]*trieNode
+	terminal bool
+}
+
+func (n *trieNode) insert(addr []byte, bits int) {
+	for i := 0; i < bits; i++ {
+		bit := addr[i/8] >> (7 - i%8) & 1
+		if n.children[bit] == nil {
+			n.children[bit] = &trieNode{}
+		}
+		n = n.children[bit]
+	}
+	n.terminal = true
+}
+
+func (n *trieNode) contains(addr []byte) bool {
+	for i := 0; n != nil; i++ {
+		if n.terminal {
+			return true
+		}
+		if i == len(addr)*8 {
+			return false
+		}
+		n = n.children[addr[i/8]>>(7-i%8)&1]
+	}
+	return false
+}
+
+func maxAddr(a, b netip.Addr) netip.Addr {
+	if a.Compare(b) >= 0 {
+		return a
+	}
+	return b
+}
+
+func minAddr(a, b netip.Addr) netip.Addr {
+	if a.Compare(b) <= 0 {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,281 @@
+package bhnet
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Limiter is a token bucket over bytes. One Limiter can be shared by any
+// number of connections to cap their combined bandwidth.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  int
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter allows rate bytes per second with bursts of up to burst bytes.
+// A burst below 1 defaults to rate.
+func NewLimiter(rate, burst int) *Limiter {
+	if rate < 1 {
+		panic("illegal argument")
+	}
+	if burst < 1 {
+		burst = rate
+	}
+
+	return &Limiter{
+		rate:   float64(rate),
+		burst:  burst,
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (l *Limiter) Burst() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.burst
+}
+
+// SetRate changes the rate, keeping the tokens already accumulated.
+func (l *Limiter) SetRate(rate int) {
+	if rate < 1 {
+		panic("illegal argument")
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	l.rate = float64(rate)
+}
+
+// WaitN blocks until n bytes may pass or ctx is done. n may exceed the
+// burst, it then simply waits longer.
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.refill(now)
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if wait == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// give back what was not used
+		l.mu.Lock()
+		l.tokens += float64(n)
+		if l.tokens > float64(l.burst) {
+			l.tokens = float64(l.burst)
+		}
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+func (l *Limiter) refill(now time.Time) {
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > float64(l.burst) {
+		l.tokens = float64(l.burst)
+	}
+	l.last = now
+}
+
+// ConnStats counts the traffic of a connection. The durations include the
+// time spent waiting for a limiter.
+type ConnStats struct {
+	ReadBytes     int64
+	WrittenBytes  int64
+	ReadDuration  time.Duration
+	WriteDuration time.Duration
+}
+
+type connCounters struct {
+	readBytes     atomic.Int64
+	writtenBytes  atomic.Int64
+	readDuration  atomic.Int64
+	writeDuration atomic.Int64
+}
+
+func (cc *connCounters) stats() ConnStats {
+	return ConnStats{
+		ReadBytes:     cc.readBytes.Load(),
+		WrittenBytes:  cc.writtenBytes.Load(),
+		ReadDuration:  time.Duration(cc.readDuration.Load()),
+		WriteDuration: time.Duration(cc.writeDuration.Load()),
+	}
+}
+
+// ConnLimits are the limiters applied to a connection, nil meaning unlimited.
+type ConnLimits struct {
+	Read  *Limiter
+	Write *Limiter
+}
+
+// MeteredConn throttles and counts the traffic of a net.Conn.
+type MeteredConn struct {
+	net.Conn
+	limits  []ConnLimits
+	own     connCounters
+	shared  *connCounters
+	ctx     context.Context
+	cancel  context.CancelFunc
+	closing sync.Once
+}
+
+// NewMeteredConn wraps c. Every set of limits applies independently, so
+// a per-connection limit can be combined with a shared one.
+func NewMeteredConn(c net.Conn, limits ...ConnLimits) *MeteredConn {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &MeteredConn{
+		Conn:   c,
+		limits: limits,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+func (mc *MeteredConn) Read(p []byte) (int, error) {
+	t0 := time.Now()
+	if burst := mc.minBurst(true); burst > 0 && len(p) > burst {
+		p = p[:burst]
+	}
+
+	n, err := mc.Conn.Read(p)
+	for _, l := range mc.limits {
+		if l.Read != nil && n > 0 {
+			// a closed connection stops the wait, the data is returned anyway
+			l.Read.WaitN(mc.ctx, n)
+		}
+	}
+
+	mc.count(&mc.own.readBytes, &mc.own.readDuration, n, t0)
+	if mc.shared != nil {
+		mc.count(&mc.shared.readBytes, &mc.shared.readDuration, n, t0)
+	}
+	return n, err
+}
+
+func (mc *MeteredConn) Write(p []byte) (int, error) {
+	t0 := time.Now()
+	chunk := len(p)
+	if burst := mc.minBurst(false); burst > 0 && burst < chunk {
+		chunk = burst
+	}
+
+	var (
+		written int
+		err     error
+	)
+	for written < len(p) && err == nil {
+		end := min(written+chunk, len(p))
+		for _, l := range mc.limits {
+			if l.Write != nil {
+				if err = l.Write.WaitN(mc.ctx, end-written); err != nil {
+					err = net.ErrClosed
+					break
+				}
+			}
+		}
+		if err != nil {
+			break
+		}
+
+		var n int
+		n, err = mc.Conn.Write(p[written:end])
+		written += n
+	}
+
+	mc.count(&mc.own.writtenBytes, &mc.own.writeDuration, written, t0)
+	if mc.shared != nil {
+		mc.count(&mc.shared.writtenBytes, &mc.shared.writeDuration, written, t0)
+	}
+	return written, err
+}
+
+func (mc *MeteredConn) Close() error {
+	mc.closing.Do(mc.cancel)
+	return mc.Conn.Close()
+}
+
+func (mc *MeteredConn) Stats() ConnStats {
+	return mc.own.stats()
+}
+
+func (mc *MeteredConn) UnwrapConn() net.Conn {
+	return mc.Conn
+}
+
+func (mc *MeteredConn) minBurst(read bool) int {
+	burst := 0
+	for _, l := range mc.limits {
+		lim := l.Write
+		if read {
+			lim = l.Read
+		}
+		if lim != nil && (burst == 0 || lim.Burst() < burst) {
+			burst = lim.Burst()
+		}
+	}
+	return burst
+}
+
+func (mc *MeteredConn) count(bytes, duration *atomic.Int64, n int, t0 time.Time) {
+	bytes.Add(int64(n))
+	duration.Add(int64(time.Since(t0)))
+}
+
+// MeteredListener wraps every accepted connection in a MeteredConn that
+// shares the listener's limits, and sums up their traffic.
+type MeteredListener struct {
+	net.Listener
+	shared  ConnLimits
+	perConn func() ConnLimits
+	total   connCounters
+}
+
+// NewMeteredListener applies shared to all connections together. perConn,
+// if not nil, is called for each accepted connection to create its own limits.
+func NewMeteredListener(ln net.Listener, shared ConnLimits, perConn func() ConnLimits) *MeteredListener {
+	return &MeteredListener{
+		Listener: ln,
+		shared:   shared,
+		perConn:  perConn,
+	}
+}
+
+func (ml *MeteredListener) Accept() (net.Conn, error) {
+	c, err := ml.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	limits := []ConnLimits{ml.shared}
+	if ml.perConn != nil {
+		limits = append(limits, ml.perConn())
+	}
+
+	mc := NewMeteredConn(c, limits...)
+	mc.shared = &ml.total
+	return mc, nil
+}
+
+// Stats returns the traffic of every connection accepted so far.
+func (ml *MeteredListener) Stats() ConnStats {
+	return ml.total.stats()
+}
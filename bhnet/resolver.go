@@ -0,0 +1,368 @@
+package bhnet
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buhuang1002/bh-go-tools/mergecaller"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	defaultDNSTimeout  = 5 * time.Second
+	defaultMaxStale    = time.Hour
+	defaultNegativeTTL = 30 * time.Second
+	// staleAnswerDelay is how long a query with a stale answer at hand
+	// waits for upstream, well within the resolver's own timeout.
+	staleAnswerDelay = time.Second
+)
+
+type ResolverOptions struct {
+	// Servers are the upstream name servers as host:port. By default the
+	// servers of the system configuration are used.
+	Servers []string
+	// Timeout bounds a single upstream query. Zero means 5 seconds.
+	Timeout time.Duration
+	// MaxStale is how long after expiry an answer is still served when
+	// the upstream servers fail or are slow to answer. Zero means one hour, negative disables it.
+	MaxStale time.Duration
+	// NegativeTTL caches answers without records that carry no SOA.
+	// Zero means 30 seconds.
+	NegativeTTL time.Duration
+}
+
+// Resolver caches DNS answers for their TTL. It answers the queries of a
+// pure Go net.Resolver, so every record type is cached, and concurrent
+// queries of the same question are sent upstream once.
+type Resolver struct {
+	opts     ResolverOptions
+	resolver *net.Resolver
+	merge    *mergecaller.MergeCaller[string, []byte]
+
+	mu      sync.Mutex
+	cache   map[string]dnsEntry
+	purgeAt int
+}
+
+type dnsEntry struct {
+	msg     []byte
+	expires time.Time
+}
+
+func NewResolver(opts ResolverOptions) *Resolver {
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultDNSTimeout
+	}
+	if opts.MaxStale == 0 {
+		opts.MaxStale = defaultMaxStale
+	}
+	if opts.NegativeTTL <= 0 {
+		opts.NegativeTTL = defaultNegativeTTL
+	}
+
+	r := &Resolver{
+		opts:  opts,
+		merge: mergecaller.NewMergeCaller[string, []byte](),
+		cache: map[string]dnsEntry{},
+	}
+	r.resolver = &net.Resolver{
+		PreferGo: true,
+		Dial:     r.dial,
+	}
+	return r
+}
+
+// NetResolver returns the caching net.Resolver, e.g. for net.Dialer.Resolver.
+func (r *Resolver) NetResolver() *net.Resolver {
+	return r.resolver
+}
+
+// Dialer returns a net.Dialer resolving names through r.
+func (r *Resolver) Dialer() *net.Dialer {
+	return &net.Dialer{Resolver: r.resolver}
+}
+
+func (r *Resolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return r.resolver.LookupHost(ctx, host)
+}
+
+// LookupNetIP looks up host for network "ip", "ip4" or "ip6".
+func (r *Resolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	return r.resolver.LookupNetIP(ctx, network, host)
+}
+
+func (r *Resolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	return r.resolver.LookupSRV(ctx, service, proto, name)
+}
+
+// Flush drops every cached answer.
+func (r *Resolver) Flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	clear(r.cache)
+}
+
+// dial hands the Go resolver one end of a pipe and answers its queries
+// on the other. A pipe is no net.PacketConn, so the queries are framed
+// like DNS over TCP.
+func (r *Resolver) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	client, server := net.Pipe()
+	go r.serveConn(server, address)
+	return client, nil
+}
+
+func (r *Resolver) serveConn(c net.Conn, address string) {
+	defer c.Close()
+
+	for {
+		var size [2]byte
+		if _, err := io.ReadFull(c, size[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(c, query); err != nil {
+			return
+		}
+
+		resp, err := r.answer(query, address)
+		if err != nil {
+			// the resolver moves on to its next server or attempt
+			return
+		}
+
+		out := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(resp)), uint16(len(resp)))
+		if _, err := c.Write(append(out, resp...)); err != nil {
+			return
+		}
+	}
+}
+
+func (r *Resolver) answer(query []byte, address string) ([]byte, error) {
+	var p dnsmessage.Parser
+	if _, err := p.Start(query); err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	key := strings.ToLower(q.Name.String()) + "/" + q.Type.String() + "/" + q.Class.String()
+
+	r.mu.Lock()
+	entry, cached := r.cache[key]
+	r.mu.Unlock()
+
+	now := time.Now()
+	if cached && now.Before(entry.expires) {
+		return withID(entry.msg, query), nil
+	}
+
+	type result struct {
+		resp []byte
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := r.merge.Call(key, func() ([]byte, error) {
+			return r.refresh(key, query, address)
+		})
+		done <- result{resp, err}
+	}()
+
+	if !cached || r.opts.MaxStale < 0 || !now.Before(entry.expires.Add(r.opts.MaxStale)) {
+		res := <-done
+		if res.err != nil {
+			return nil, res.err
+		}
+		return withID(res.resp, query), nil
+	}
+
+	// the refresh goes on in the background if upstream is slow
+	timer := time.NewTimer(staleAnswerDelay)
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		if res.err == nil {
+			return withID(res.resp, query), nil
+		}
+	case <-timer.C:
+	}
+	return withID(entry.msg, query), nil
+}
+
+// refresh queries upstream and caches a successful or NXDOMAIN answer.
+func (r *Resolver) refresh(key string, query []byte, address string) ([]byte, error) {
+	resp, err := r.exchange(query, address)
+	if err != nil {
+		return nil, err
+	}
+
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		return nil, err
+	}
+	if h.RCode != dnsmessage.RCodeSuccess && h.RCode != dnsmessage.RCodeNameError {
+		return nil, fmt.Errorf("dns %s: %s", key, h.RCode)
+	}
+
+	if ttl := r.ttl(&p); ttl > 0 {
+		r.mu.Lock()
+		if len(r.cache) >= r.purgeAt {
+			r.purgeLocked(time.Now())
+			r.purgeAt = max(2*len(r.cache), 1024)
+		}
+		r.cache[key] = dnsEntry{msg: resp, expires: time.Now().Add(ttl)}
+		r.mu.Unlock()
+	}
+	return resp, nil
+}
+
+// ttl is the lowest TTL of the answers, or for an empty answer the
+// negative TTL of the SOA record.
+func (r *Resolver) ttl(p *dnsmessage.Parser) time.Duration {
+	if err := p.SkipAllQuestions(); err != nil {
+		return 0
+	}
+
+	var (
+		minTTL  uint32
+		answers int
+	)
+	for {
+		h, err := p.AnswerHeader()
+		if err != nil {
+			break
+		}
+		if answers == 0 || h.TTL < minTTL {
+			minTTL = h.TTL
+		}
+		answers++
+		if err := p.SkipAnswer(); err != nil {
+			return 0
+		}
+	}
+	if answers > 0 {
+		return time.Duration(minTTL) * time.Second
+	}
+
+	for {
+		h, err := p.AuthorityHeader()
+		if err != nil {
+			return r.opts.NegativeTTL
+		}
+		if h.Type != dnsmessage.TypeSOA {
+			if err := p.SkipAuthority(); err != nil {
+				return r.opts.NegativeTTL
+			}
+			continue
+		}
+
+		soa, err := p.SOAResource()
+		if err != nil {
+			return r.opts.NegativeTTL
+		}
+		return time.Duration(min(h.TTL, soa.MinTTL)) * time.Second
+	}
+}
+
+// purgeLocked drops the entries that can't even be served stale anymore.
+func (r *Resolver) purgeLocked(now time.Time) {
+	for key, entry := range r.cache {
+		if now.After(entry.expires.Add(max(r.opts.MaxStale, 0))) {
+			delete(r.cache, key)
+		}
+	}
+}
+
+// exchange sends query to the configured servers in turn, or to address
+// if there are none. Truncated UDP answers are retried over TCP.
+func (r *Resolver) exchange(query []byte, address string) ([]byte, error) {
+	servers := r.opts.Servers
+	if len(servers) == 0 {
+		servers = []string{address}
+	}
+
+	var errs []error
+	for _, server := range servers {
+		resp, err := r.exchangeWith("udp", server, query)
+		if err == nil && resp[2]&0x02 != 0 {
+			resp, err = r.exchangeWith("tcp", server, query)
+		}
+		if err == nil {
+			return resp, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (r *Resolver) exchangeWith(network, server string, query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.opts.Timeout)
+	defer cancel()
+
+	var d net.Dialer
+	c, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	deadline, _ := ctx.Deadline()
+	c.SetDeadline(deadline)
+
+	var resp []byte
+	if network == "udp" {
+		if _, err := c.Write(query); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := c.Read(buf)
+			if err != nil {
+				return nil, err
+			}
+			// ignore stray packets of other queries
+			if n >= 12 && buf[0] == query[0] && buf[1] == query[1] {
+				resp = buf[:n:n]
+				break
+			}
+		}
+	} else {
+		out := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(query)), uint16(len(query)))
+		if _, err := c.Write(append(out, query...)); err != nil {
+			return nil, err
+		}
+		var size [2]byte
+		if _, err := io.ReadFull(c, size[:]); err != nil {
+			return nil, err
+		}
+		resp = make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(c, resp); err != nil {
+			return nil, err
+		}
+		if len(resp) < 12 || resp[0] != query[0] || resp[1] != query[1] {
+			return nil, fmt.Errorf("dns %s: mismatched response", server)
+		}
+	}
+
+	if resp[2]&0x80 == 0 {
+		return nil, fmt.Errorf("dns %s: response is a query", server)
+	}
+	return resp, nil
+}
+
+// withID returns a copy of resp answering query.
+func withID(resp, query []byte) []byte {
+	out := append([]byte(nil), resp...)
+	out[0], out[1] = query[0], query[1]
+	return out
+}
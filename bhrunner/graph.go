@@ -0,0 +1,431 @@
+package bhrunner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GraphTask is a node of a Graph. Start brings the task up, its dependents
+// start once it returned nil. Run, if set, keeps running afterwards until
+// the graph stops, and Stop tears the task down. Any of them may be nil.
+type GraphTask struct {
+	Name  string
+	Deps  []string
+	Start func(ctx context.Context) error
+	Run   func(ctx context.Context) error
+	Stop  func(ctx context.Context) error
+}
+
+type GraphOptions struct {
+	// Parallelism limits how many Start funcs run at once, zero meaning no
+	// limit.
+	Parallelism int
+}
+
+// CycleError is returned by NewGraph for tasks that depend on themselves.
+type CycleError struct {
+	Cycle []string
+}
+
+func (e *CycleError) Error() string {
+	return "dependency cycle: " + strings.Join(e.Cycle, " -> ")
+}
+
+type GraphTaskState int
+
+const (
+	GraphPending GraphTaskState = iota
+	GraphStarting
+	GraphRunning
+	GraphStopped
+	GraphFailed
+	// GraphCancelled is a task whose dependency failed.
+	GraphCancelled
+)
+
+func (s GraphTaskState) String() string {
+	switch s {
+	case GraphPending:
+		return "pending"
+	case GraphStarting:
+		return "starting"
+	case GraphRunning:
+		return "running"
+	case GraphStopped:
+		return "stopped"
+	case GraphFailed:
+		return "failed"
+	case GraphCancelled:
+		return "cancelled"
+	default:
+		return fmt.Sprintf("GraphTaskState(%d)", int(s))
+	}
+}
+
+// GraphTaskStatus is a snapshot of a graph task.
+type GraphTaskStatus struct {
+	Name      string
+	State     GraphTaskState
+	StartedAt time.Time
+	LastError error
+}
+
+// Graph starts tasks in dependency order, independent tasks concurrently,
+// and stops them in reverse order. The Run funcs are named tasks of a
+// GroupRunner.
+type Graph struct {
+	opts   GraphOptions
+	nodes  []*graphNode // topological order
+	runner *GroupRunner
+
+	mu        sync.Mutex
+	ctx       context.Context
+	cancel    context.CancelFunc
+	stopping  bool
+	startDone chan struct{}
+}
+
+type graphNode struct {
+	task       GraphTask
+	deps       []*graphNode
+	dependents []*graphNode
+
+	status GraphTaskStatus
+	// up is set once Start returned nil, Stop is only called then
+	up     bool
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewGraph checks that every dependency exists and that there are no
+// cycles, and sorts the tasks topologically.
+func NewGraph(opts GraphOptions, tasks ...GraphTask) (*Graph, error) {
+	if opts.Parallelism < 0 {
+		panic("illegal argument")
+	}
+
+	byName := make(map[string]*graphNode, len(tasks))
+	declared := make([]*graphNode, 0, len(tasks))
+	for _, t := range tasks {
+		if _, ok := byName[t.Name]; ok {
+			return nil, fmt.Errorf("task %q already exists", t.Name)
+		}
+		n := &graphNode{task: t, status: GraphTaskStatus{Name: t.Name}}
+		byName[t.Name] = n
+		declared = append(declared, n)
+	}
+	for _, n := range declared {
+		for _, dep := range n.task.Deps {
+			d, ok := byName[dep]
+			if !ok {
+				return nil, fmt.Errorf("task %q depends on unknown task %q", n.task.Name, dep)
+			}
+			n.deps = append(n.deps, d)
+			d.dependents = append(d.dependents, n)
+		}
+	}
+
+	// depth first, dependencies before dependents, declaration order otherwise
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	marks := make(map[*graphNode]int, len(declared))
+	order := make([]*graphNode, 0, len(declared))
+	var path []*graphNode
+	var visit func(n *graphNode) error
+	visit = func(n *graphNode) error {
+		switch marks[n] {
+		case visited:
+			return nil
+		case visiting:
+			cycle := []string{n.task.Name}
+			for i := len(path) - 1; path[i] != n; i-- {
+				cycle = append(cycle, path[i].task.Name)
+			}
+			cycle = append(cycle, n.task.Name)
+			// path runs from dependent to dependency, reverse it
+			for i, j := 0, len(cycle)-1; i < j; i, j = i+1, j-1 {
+				cycle[i], cycle[j] = cycle[j], cycle[i]
+			}
+			return &CycleError{Cycle: cycle}
+		}
+
+		marks[n] = visiting
+		path = append(path, n)
+		for _, d := range n.deps {
+			if err := visit(d); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		marks[n] = visited
+		order = append(order, n)
+		return nil
+	}
+	for _, n := range declared {
+		if err := visit(n); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Graph{
+		opts:   opts,
+		nodes:  order,
+		runner: NewGroupRunner(),
+	}, nil
+}
+
+// Order returns the task names in the order they are started.
+func (g *Graph) Order() []string {
+	names := make([]string, len(g.nodes))
+	for i, n := range g.nodes {
+		names[i] = n.task.Name
+	}
+	return names
+}
+
+// Start starts every task whose dependencies are up and returns once no
+// more task can be started. A task that fails, in Start or later in Run,
+// cancels its dependents, the other tasks keep going. The returned error
+// joins the failures of Start; ctx is the parent of every task's context.
+func (g *Graph) Start(ctx context.Context) error {
+	g.mu.Lock()
+	if g.ctx != nil {
+		g.mu.Unlock()
+		return errors.New("graph already started")
+	}
+	g.ctx, g.cancel = context.WithCancel(ctx)
+	g.stopping = false
+	g.startDone = make(chan struct{})
+	defer close(g.startDone)
+	for _, n := range g.nodes {
+		n.status = GraphTaskStatus{Name: n.task.Name}
+		n.up = false
+		n.cancel = nil
+		n.done = nil
+	}
+	g.mu.Unlock()
+
+	limit := g.opts.Parallelism
+	if limit == 0 {
+		limit = len(g.nodes)
+	}
+
+	var errs []error
+	results := make(chan error)
+	inflight := 0
+	for {
+		g.mu.Lock()
+		for inflight < limit {
+			n := g.nextLocked()
+			if n == nil {
+				break
+			}
+			inflight++
+			g.startLocked(n, results)
+		}
+		g.mu.Unlock()
+
+		if inflight == 0 {
+			break
+		}
+		if err := <-results; err != nil {
+			errs = append(errs, err)
+		}
+		inflight--
+	}
+
+	if err := ctx.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// nextLocked returns the first pending task whose dependencies are up.
+func (g *Graph) nextLocked() *graphNode {
+	if g.stopping || g.ctx.Err() != nil {
+		return nil
+	}
+next:
+	for _, n := range g.nodes {
+		if n.status.State != GraphPending {
+			continue
+		}
+		for _, d := range n.deps {
+			if !d.up || d.status.State != GraphRunning && d.status.State != GraphStopped {
+				continue next
+			}
+		}
+		return n
+	}
+	return nil
+}
+
+func (g *Graph) startLocked(n *graphNode, results chan<- error) {
+	ctx, cancel := context.WithCancel(g.ctx)
+	n.cancel = cancel
+	n.status.State = GraphStarting
+	n.status.StartedAt = time.Now()
+
+	go func() {
+		var err error
+		if n.task.Start != nil {
+			err = runChild(ctx, n.task.Start)
+		}
+		results <- g.setStarted(ctx, n, err)
+	}()
+}
+
+// setStarted records the outcome of n's Start.
+func (g *Graph) setStarted(ctx context.Context, n *graphNode, err error) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	switch {
+	case n.status.State == GraphCancelled:
+		// a dependency failed meanwhile
+		n.up = err == nil
+		return nil
+	case err != nil && ctx.Err() != nil && errors.Is(err, ctx.Err()):
+		// cancelled by Stop
+		n.status.State = GraphStopped
+		return nil
+	case err != nil:
+		n.status.State = GraphFailed
+		n.status.LastError = err
+		g.cancelDependentsLocked(n)
+		return fmt.Errorf("%s: %w", n.task.Name, err)
+	}
+
+	n.up = true
+	n.status.State = GraphRunning
+	if n.task.Run != nil {
+		g.runLocked(ctx, n)
+	}
+	return nil
+}
+
+func (g *Graph) runLocked(ctx context.Context, n *graphNode) {
+	done := make(chan struct{})
+	n.done = done
+	g.runner.GoNamed(ctx, n.task.Name, nil, func(ctx context.Context) error {
+		defer close(done)
+		err := runChild(ctx, n.task.Run)
+
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if n.status.State == GraphRunning {
+			n.status.State = GraphStopped
+			if err != nil && ctx.Err() == nil {
+				n.status.State = GraphFailed
+				n.status.LastError = err
+				g.cancelDependentsLocked(n)
+			}
+		}
+		return err
+	})
+}
+
+// cancelDependentsLocked cancels every task that depends on n, directly or
+// not.
+func (g *Graph) cancelDependentsLocked(n *graphNode) {
+	for _, d := range n.dependents {
+		switch d.status.State {
+		case GraphCancelled, GraphFailed:
+			continue
+		case GraphStarting, GraphRunning:
+			d.cancel()
+		}
+		d.status.State = GraphCancelled
+		d.status.LastError = fmt.Errorf("dependency %q failed", n.task.Name)
+		g.cancelDependentsLocked(d)
+	}
+}
+
+// Stop stops the tasks in reverse order, each once its dependents are
+// stopped: its context is cancelled, its Run awaited and its Stop called.
+// Tasks still starting are cancelled first. When ctx is done, the rest is
+// cancelled at once and the error names the Run funcs still running.
+func (g *Graph) Stop(ctx context.Context) error {
+	g.mu.Lock()
+	if g.ctx == nil {
+		g.mu.Unlock()
+		return nil
+	}
+	g.stopping = true
+	for _, n := range g.nodes {
+		if n.status.State == GraphStarting {
+			n.cancel()
+		}
+	}
+	startDone := g.startDone
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		g.cancel()
+		g.ctx = nil
+		g.mu.Unlock()
+	}()
+
+	select {
+	case <-startDone:
+	case <-ctx.Done():
+		g.cancel()
+		return g.runner.Stop(ctx)
+	}
+
+	var errs []error
+	for i := len(g.nodes) - 1; i >= 0; i-- {
+		n := g.nodes[i]
+
+		g.mu.Lock()
+		cancel, done, up := n.cancel, n.done, n.up
+		g.mu.Unlock()
+		if cancel == nil {
+			continue
+		}
+
+		cancel()
+		if done != nil {
+			select {
+			case <-done:
+			case <-ctx.Done():
+				g.cancel()
+				return errors.Join(append(errs, g.runner.Stop(ctx))...)
+			}
+		}
+		if up && n.task.Stop != nil {
+			if err := runChild(ctx, n.task.Stop); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", n.task.Name, err))
+			}
+		}
+
+		g.mu.Lock()
+		if n.status.State == GraphRunning {
+			n.status.State = GraphStopped
+		}
+		g.mu.Unlock()
+	}
+
+	errs = append(errs, g.runner.Stop(ctx))
+	return errors.Join(errs...)
+}
+
+// Tasks returns the status of every task in topological order.
+func (g *Graph) Tasks() []GraphTaskStatus {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	tasks := make([]GraphTaskStatus, len(g.nodes))
+	for i, n := range g.nodes {
+		tasks[i] = n.status
+	}
+	return tasks
+}
@@ -2,55 +2,275 @@ package bhrunner
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 )
 
-// GroupRunner manages multiple cancellable goroutines.
+type GroupRunnerOptions struct {
+	// CancelOnError cancels every running task as soon as one fails.
+	CancelOnError bool
+}
+
+type TaskState int
+
+const (
+	TaskRunning TaskState = iota
+	TaskStopped
+	TaskFailed
+)
+
+func (s TaskState) String() string {
+	switch s {
+	case TaskRunning:
+		return "running"
+	case TaskStopped:
+		return "stopped"
+	case TaskFailed:
+		return "failed"
+	default:
+		return fmt.Sprintf("TaskState(%d)", int(s))
+	}
+}
+
+// TaskStatus is a snapshot of a task. Restarts counts how often a task
+// with the same name was started again.
+type TaskStatus struct {
+	Name      string
+	Labels    map[string]string
+	State     TaskState
+	StartedAt time.Time
+	LastError error
+	Restarts  int
+}
+
+// StopTimeoutError is returned by Stop when tasks are still running.
+type StopTimeoutError struct {
+	Err     error
+	Running []string
+}
+
+func (e *StopTimeoutError) Error() string {
+	return fmt.Sprintf("%v, still running: %s", e.Err, strings.Join(e.Running, ", "))
+}
+
+func (e *StopTimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// GroupRunner manages multiple cancellable goroutines. The zero value is
+// ready to use.
 type GroupRunner struct {
-	mu      sync.Mutex
-	wg      sync.WaitGroup
-	cancels []context.CancelFunc
+	opts GroupRunnerOptions
+
+	mu     sync.Mutex
+	nextID uint64
+	tasks  map[uint64]*groupTask
+	named  map[string]*namedTask
+	order  []string
+	errs   []error
+	idle   chan struct{}
+}
+
+type groupTask struct {
+	name      string
+	named     bool
+	cancel    context.CancelFunc
+	startedAt time.Time
+}
+
+// namedTask is the status of the latest task started under a name.
+type namedTask struct {
+	status TaskStatus
+	id     uint64
 }
 
 // NewGroupRunner creates a new GroupRunner instance.
 func NewGroupRunner() *GroupRunner {
-	return &GroupRunner{}
+	return NewGroupRunnerWithOptions(GroupRunnerOptions{})
+}
+
+// NewGroupRunnerWithOptions creates a GroupRunner with the given options.
+func NewGroupRunnerWithOptions(opts GroupRunnerOptions) *GroupRunner {
+	return &GroupRunner{
+		opts:  opts,
+		tasks: map[uint64]*groupTask{},
+		named: map[string]*namedTask{},
+	}
 }
 
 // Go starts a new task with its own cancelable context.
 func (g *GroupRunner) Go(parent context.Context, run func(ctx context.Context)) {
+	g.GoE(parent, func(ctx context.Context) error {
+		run(ctx)
+		return nil
+	})
+}
+
+// GoE starts a new task that may fail. Errors are reported by Wait and Stop,
+// prefixed with "#id", except those of a task returning its own context's
+// error after it was cancelled.
+func (g *GroupRunner) GoE(parent context.Context, run func(ctx context.Context) error) {
+	g.GoNamed(parent, "", nil, run)
+}
+
+// GoNamed starts a task like GoE that shows up in Tasks under name, also
+// after it returned. An empty name only shows up while running.
+func (g *GroupRunner) GoNamed(parent context.Context, name string, labels map[string]string, run func(ctx context.Context) error) {
 	ctx, cancel := context.WithCancel(parent)
 
 	g.mu.Lock()
-	g.cancels = append(g.cancels, cancel)
-	g.wg.Add(1)
+	if g.tasks == nil {
+		g.tasks = map[uint64]*groupTask{}
+		g.named = map[string]*namedTask{}
+	}
+	g.nextID++
+	id := g.nextID
+	t := &groupTask{name: name, named: name != "", cancel: cancel, startedAt: time.Now()}
+	if name == "" {
+		t.name = fmt.Sprintf("#%d", id)
+	} else if nt, ok := g.named[name]; ok {
+		nt.id = id
+		nt.status.State = TaskRunning
+		nt.status.StartedAt = t.startedAt
+		nt.status.Labels = maps.Clone(labels)
+		nt.status.Restarts++
+	} else {
+		g.named[name] = &namedTask{
+			status: TaskStatus{
+				Name:      name,
+				Labels:    maps.Clone(labels),
+				State:     TaskRunning,
+				StartedAt: t.startedAt,
+			},
+			id: id,
+		}
+		g.order = append(g.order, name)
+	}
+	g.tasks[id] = t
+	if len(g.tasks) == 1 {
+		g.idle = make(chan struct{})
+	}
 	g.mu.Unlock()
 
 	go func() {
-		defer g.wg.Done()
-		run(ctx)
+		err := run(ctx)
+		if err != nil && ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+			err = nil
+		}
+		cancel()
+
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		delete(g.tasks, id)
+		if nt, ok := g.named[name]; ok && nt.id == id {
+			nt.status.State = TaskStopped
+			nt.status.LastError = err
+			if err != nil {
+				nt.status.State = TaskFailed
+			}
+		}
+		if err != nil {
+			err = fmt.Errorf("%s: %w", t.name, err)
+			g.errs = append(g.errs, err)
+			if g.opts.CancelOnError {
+				for _, t := range g.tasks {
+					t.cancel()
+				}
+			}
+		}
+		if len(g.tasks) == 0 {
+			close(g.idle)
+		}
 	}()
 }
 
-// Stop cancels all running tasks and waits for them to finish.
+// Tasks returns the status of the named tasks in the order they were
+// first started, followed by the running unnamed tasks.
+func (g *GroupRunner) Tasks() []TaskStatus {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	tasks := make([]TaskStatus, 0, len(g.order))
+	for _, name := range g.order {
+		st := g.named[name].status
+		st.Labels = maps.Clone(st.Labels)
+		tasks = append(tasks, st)
+	}
+	for _, id := range g.sortedIDs() {
+		if t := g.tasks[id]; !t.named {
+			tasks = append(tasks, TaskStatus{Name: t.name, State: TaskRunning, StartedAt: t.startedAt})
+		}
+	}
+	return tasks
+}
+
+// Wait waits for all tasks to finish and returns the errors of the tasks
+// that failed since the last Wait or Stop.
+func (g *GroupRunner) Wait() error {
+	<-g.idleChan()
+	return g.takeErrs()
+}
+
+// Stop cancels all running tasks and waits for them to finish. The runner
+// can be used again afterwards. When ctx is done first, the error is a
+// *StopTimeoutError naming the tasks still running.
 func (g *GroupRunner) Stop(ctx context.Context) error {
 	g.mu.Lock()
-	for _, cancel := range g.cancels {
-		cancel()
+	for _, t := range g.tasks {
+		t.cancel()
 	}
-	g.cancels = nil
 	g.mu.Unlock()
 
-	done := make(chan struct{})
-	go func() {
-		g.wg.Wait()
-		close(done)
-	}()
-
 	select {
-	case <-done:
-		return nil
+	case <-g.idleChan():
+		return g.takeErrs()
 	case <-ctx.Done():
-		return ctx.Err()
+		g.mu.Lock()
+		running := make([]string, 0, len(g.tasks))
+		for _, id := range g.sortedIDs() {
+			running = append(running, g.tasks[id].name)
+		}
+		g.mu.Unlock()
+
+		timeout := &StopTimeoutError{Err: ctx.Err(), Running: running}
+		if err := g.takeErrs(); err != nil {
+			return errors.Join(timeout, err)
+		}
+		return timeout
+	}
+}
+
+func (g *GroupRunner) sortedIDs() []uint64 {
+	ids := make([]uint64, 0, len(g.tasks))
+	for id := range g.tasks {
+		ids = append(ids, id)
 	}
+	slices.Sort(ids)
+	return ids
+}
+
+func (g *GroupRunner) idleChan() <-chan struct{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if len(g.tasks) == 0 {
+		idle := make(chan struct{})
+		close(idle)
+		return idle
+	}
+	return g.idle
+}
+
+func (g *GroupRunner) takeErrs() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	err := errors.Join(g.errs...)
+	g.errs = nil
+	return err
 }
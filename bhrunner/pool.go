@@ -0,0 +1,244 @@
+package bhrunner
+
+import (
+	"context"
+	"errors"
+	"runtime/debug"
+	"sync"
+)
+
+var (
+	ErrPoolStopped = errors.New("pool stopped")
+	ErrQueueFull   = errors.New("pool queue full")
+)
+
+// Pool runs tasks on a fixed number of workers. Tasks wait in a bounded
+// queue, submitting to a full queue blocks or fails.
+type Pool struct {
+	queue chan func(ctx context.Context)
+	ctx   context.Context
+	abort context.CancelFunc
+
+	mu         sync.Mutex
+	target     int
+	running    int
+	wake       chan struct{}
+	stopped    bool
+	stopping   chan struct{}
+	submitting sync.WaitGroup
+	drain      chan struct{}
+	workers    sync.WaitGroup
+}
+
+// NewPool starts workers goroutines sharing a queue of queueSize tasks.
+func NewPool(workers, queueSize int) *Pool {
+	if workers < 1 || queueSize < 0 {
+		panic("illegal argument")
+	}
+
+	ctx, abort := context.WithCancel(context.Background())
+	p := &Pool{
+		queue:    make(chan func(ctx context.Context), queueSize),
+		ctx:      ctx,
+		abort:    abort,
+		wake:     make(chan struct{}),
+		stopping: make(chan struct{}),
+		drain:    make(chan struct{}),
+	}
+	p.Resize(workers)
+	return p
+}
+
+// Submit queues task, waiting while the queue is full. The task's context
+// is cancelled when Stop gives up waiting.
+func (p *Pool) Submit(task func(ctx context.Context)) error {
+	return p.SubmitCtx(context.Background(), task)
+}
+
+// TrySubmit queues task or fails with ErrQueueFull.
+func (p *Pool) TrySubmit(task func(ctx context.Context)) error {
+	if !p.beginSubmit() {
+		return ErrPoolStopped
+	}
+	defer p.submitting.Done()
+
+	select {
+	case p.queue <- task:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// SubmitCtx queues task, waiting while the queue is full until ctx is done.
+func (p *Pool) SubmitCtx(ctx context.Context, task func(ctx context.Context)) error {
+	if !p.beginSubmit() {
+		return ErrPoolStopped
+	}
+	defer p.submitting.Done()
+
+	select {
+	case p.queue <- task:
+		return nil
+	case <-p.stopping:
+		return ErrPoolStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *Pool) beginSubmit() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.stopped {
+		return false
+	}
+	p.submitting.Add(1)
+	return true
+}
+
+// Resize changes the number of workers. Surplus workers exit after their
+// current task.
+func (p *Pool) Resize(workers int) {
+	if workers < 1 {
+		panic("illegal argument")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.stopped {
+		return
+	}
+	p.target = workers
+	for p.running < p.target {
+		p.running++
+		p.workers.Add(1)
+		go p.work()
+	}
+	if p.running > p.target {
+		close(p.wake)
+		p.wake = make(chan struct{})
+	}
+}
+
+// Workers returns the number of running workers.
+func (p *Pool) Workers() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.running
+}
+
+// Queued returns the number of tasks waiting for a worker.
+func (p *Pool) Queued() int {
+	return len(p.queue)
+}
+
+// Stop stops accepting tasks and waits until the queued ones are done. When
+// ctx is done first, the context of the running tasks is cancelled and
+// the queue is still drained in the background.
+func (p *Pool) Stop(ctx context.Context) error {
+	p.mu.Lock()
+	if !p.stopped {
+		p.stopped = true
+		close(p.stopping)
+		p.mu.Unlock()
+
+		// nothing is queued anymore once the submitters are gone
+		p.submitting.Wait()
+		close(p.drain)
+	} else {
+		p.mu.Unlock()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		p.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		p.abort()
+		return nil
+	case <-ctx.Done():
+		p.abort()
+		return ctx.Err()
+	}
+}
+
+func (p *Pool) work() {
+	defer p.workers.Done()
+
+	for {
+		p.mu.Lock()
+		if p.running > p.target {
+			p.running--
+			p.mu.Unlock()
+			return
+		}
+		wake := p.wake
+		p.mu.Unlock()
+
+		select {
+		case task := <-p.queue:
+			task(p.ctx)
+		case <-wake:
+		case <-p.drain:
+			for {
+				select {
+				case task := <-p.queue:
+					task(p.ctx)
+				default:
+					p.mu.Lock()
+					p.running--
+					p.mu.Unlock()
+					return
+				}
+			}
+		}
+	}
+}
+
+// Future is the result of a task submitted with SubmitFunc.
+type Future[T any] struct {
+	done chan struct{}
+	v    T
+	err  error
+}
+
+// Done is closed once the result is available.
+func (f *Future[T]) Done() <-chan struct{} {
+	return f.done
+}
+
+// Get waits for the result until ctx is done.
+func (f *Future[T]) Get(ctx context.Context) (T, error) {
+	select {
+	case <-f.done:
+		return f.v, f.err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+// SubmitFunc queues fn like SubmitCtx and returns its future result. A panic
+// of fn is returned as a *PanicError.
+func SubmitFunc[T any](ctx context.Context, p *Pool, fn func(ctx context.Context) (T, error)) (*Future[T], error) {
+	f := &Future[T]{done: make(chan struct{})}
+	err := p.SubmitCtx(ctx, func(ctx context.Context) {
+		defer close(f.done)
+		defer func() {
+			if v := recover(); v != nil {
+				f.err = &PanicError{Value: v, Stack: debug.Stack()}
+			}
+		}()
+		f.v, f.err = fn(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
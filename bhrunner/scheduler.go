@@ -0,0 +1,334 @@
+package bhrunner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/buhuang1002/bh-go-tools/bhtime"
+)
+
+// OverlapPolicy decides what happens when a job is due while it still runs.
+type OverlapPolicy int
+
+const (
+	// OverlapSkip drops the run.
+	OverlapSkip OverlapPolicy = iota
+	// OverlapQueue runs it as soon as the current run is done.
+	OverlapQueue
+)
+
+// CatchUpPolicy decides what happens with runs that were due while the
+// scheduler was late, e.g. because the machine was suspended, or before
+// JobOptions.LastRun was restored.
+type CatchUpPolicy int
+
+const (
+	// CatchUpOnce runs once for all the missed runs.
+	CatchUpOnce CatchUpPolicy = iota
+	// CatchUpAll runs every missed run, up to MaxCatchUp.
+	CatchUpAll
+	// CatchUpSkip drops every run that is later than CatchUpGrace.
+	CatchUpSkip
+)
+
+const (
+	MaxCatchUp          = 100
+	DefaultCatchUpGrace = time.Second
+)
+
+type JobOptions struct {
+	// Jitter delays every run by a random duration below it.
+	Jitter  time.Duration
+	Overlap OverlapPolicy
+	CatchUp CatchUpPolicy
+	// CatchUpGrace is how late a run may be with CatchUpSkip, one second
+	// by default.
+	CatchUpGrace time.Duration
+	// Location is the time zone cron expressions are evaluated in, the
+	// local zone by default.
+	Location *time.Location
+	// LastRun resumes the schedule after the last run of a previous process.
+	LastRun time.Time
+}
+
+// JobStatus is a snapshot of a scheduled job.
+type JobStatus struct {
+	Name      string
+	Next      time.Time
+	LastRun   time.Time
+	LastError error
+	Runs      int
+	Skipped   int
+	Running   bool
+}
+
+// Scheduler runs jobs at fixed intervals or on cron schedules. Every job
+// is a named task of a GroupRunner, so a Stop that times out names the
+// jobs that are stuck.
+type Scheduler struct {
+	clock  bhtime.Clock
+	runner *GroupRunner
+
+	mu   sync.Mutex
+	jobs []*scheduledJob
+	ctx  context.Context
+}
+
+type scheduledJob struct {
+	name     string
+	schedule bhtime.Schedule
+	run      func(ctx context.Context) error
+	opts     JobOptions
+
+	status  JobStatus
+	pending int
+	// handled is the last due time run or skipped, a restart resumes there
+	handled time.Time
+}
+
+// NewScheduler creates a Scheduler on clock, nil meaning the system clock.
+func NewScheduler(clock bhtime.Clock) *Scheduler {
+	if clock == nil {
+		clock = bhtime.SystemClock
+	}
+	return &Scheduler{
+		clock:  clock,
+		runner: NewGroupRunner(),
+	}
+}
+
+// Every runs the job every interval, the first time one interval after
+// the scheduler starts.
+func (s *Scheduler) Every(name string, interval time.Duration, run func(ctx context.Context) error, opts JobOptions) error {
+	if interval <= 0 {
+		return fmt.Errorf("job %q: interval must be positive", name)
+	}
+	return s.Add(name, bhtime.Every(interval), run, opts)
+}
+
+// Cron runs the job on a cron expression, see bhtime.ParseCron.
+func (s *Scheduler) Cron(name, expr string, run func(ctx context.Context) error, opts JobOptions) error {
+	cs, err := bhtime.ParseCron(expr)
+	if err != nil {
+		return fmt.Errorf("job %q: %w", name, err)
+	}
+	if cs.Location() == nil {
+		loc := opts.Location
+		if loc == nil {
+			loc = time.Local
+		}
+		cs = cs.In(loc)
+	}
+	return s.Add(name, cs, run, opts)
+}
+
+// Add runs the job on any schedule. Jobs added after Start start right away.
+func (s *Scheduler) Add(name string, schedule bhtime.Schedule, run func(ctx context.Context) error, opts JobOptions) error {
+	if run == nil {
+		return fmt.Errorf("job %q has no run func", name)
+	}
+	if opts.CatchUpGrace <= 0 {
+		opts.CatchUpGrace = DefaultCatchUpGrace
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, j := range s.jobs {
+		if j.name == name {
+			return fmt.Errorf("job %q already exists", name)
+		}
+	}
+
+	j := &scheduledJob{
+		name:     name,
+		schedule: schedule,
+		run:      run,
+		opts:     opts,
+		status:   JobStatus{Name: name, LastRun: opts.LastRun},
+	}
+	s.jobs = append(s.jobs, j)
+	if s.ctx != nil {
+		s.startLocked(j)
+	}
+	return nil
+}
+
+// Start schedules every job until Stop is called or ctx is done.
+func (s *Scheduler) Start(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ctx != nil {
+		return errors.New("scheduler already started")
+	}
+	s.ctx = ctx
+	for _, j := range s.jobs {
+		s.startLocked(j)
+	}
+	return nil
+}
+
+// Stop stops scheduling and waits for running jobs to return. The
+// scheduler can be started again afterwards.
+func (s *Scheduler) Stop(ctx context.Context) error {
+	s.mu.Lock()
+	s.ctx = nil
+	s.mu.Unlock()
+
+	return s.runner.Stop(ctx)
+}
+
+// Jobs returns the status of every job in the order they were added.
+func (s *Scheduler) Jobs() []JobStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	jobs := make([]JobStatus, len(s.jobs))
+	for i, j := range s.jobs {
+		jobs[i] = j.status
+	}
+	return jobs
+}
+
+func (s *Scheduler) startLocked(j *scheduledJob) {
+	s.runner.GoNamed(s.ctx, j.name, nil, func(ctx context.Context) error {
+		s.loop(ctx, j)
+		return nil
+	})
+}
+
+// loop waits for each due time and hands the runs to a runner goroutine,
+// so that a long run never delays the schedule.
+func (s *Scheduler) loop(ctx context.Context, j *scheduledJob) {
+	var running sync.WaitGroup
+	defer running.Wait()
+
+	s.mu.Lock()
+	last := j.handled
+	if last.IsZero() {
+		last = j.status.LastRun
+	}
+	s.mu.Unlock()
+	if last.IsZero() {
+		last = s.clock.Now()
+	}
+
+	for {
+		next := j.schedule.Next(last)
+		if next.IsZero() || !next.After(last) {
+			return
+		}
+		s.setNext(j, next)
+
+		delay := next.Sub(s.clock.Now())
+		if j.opts.Jitter > 0 {
+			delay += rand.N(j.opts.Jitter)
+		}
+		timer := s.clock.NewTimer(delay)
+		select {
+		case <-timer.C():
+		case <-ctx.Done():
+			timer.Stop()
+			s.setNext(j, time.Time{})
+			return
+		}
+
+		now := s.clock.Now()
+		var due int
+		last, due = lastDue(j.schedule, next, now)
+		s.mu.Lock()
+		j.handled = last
+		s.mu.Unlock()
+
+		runs := 1
+		switch j.opts.CatchUp {
+		case CatchUpAll:
+			runs = min(due, MaxCatchUp)
+		case CatchUpSkip:
+			if now.Sub(last) > j.opts.CatchUpGrace+j.opts.Jitter {
+				runs = 0
+			}
+		}
+		s.trigger(ctx, j, runs, due-runs, &running)
+	}
+}
+
+// maxDueScan bounds the walk of lastDue over a long downtime, the rest is
+// picked up by the next iteration of loop.
+const maxDueScan = 1 << 20
+
+// lastDue returns the last activation of schedule up to now, starting at
+// next, and how many there are in total.
+func lastDue(schedule bhtime.Schedule, next, now time.Time) (time.Time, int) {
+	if every, ok := schedule.(bhtime.Every); ok {
+		missed := max(now.Sub(next)/time.Duration(every), 0)
+		return next.Add(missed * time.Duration(every)), int(missed) + 1
+	}
+
+	last, due := next, 1
+	for due < maxDueScan {
+		after := schedule.Next(last)
+		if after.IsZero() || !after.After(last) || after.After(now) {
+			break
+		}
+		last = after
+		due++
+	}
+	return last, due
+}
+
+func (s *Scheduler) setNext(j *scheduledJob, next time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j.status.Next = next
+}
+
+// trigger starts runs runs of j, subject to its overlap policy.
+func (s *Scheduler) trigger(ctx context.Context, j *scheduledJob, runs, skipped int, running *sync.WaitGroup) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j.status.Skipped += skipped
+	if runs == 0 {
+		return
+	}
+
+	if j.status.Running {
+		if j.opts.Overlap == OverlapQueue {
+			j.pending += runs
+		} else {
+			j.status.Skipped += runs
+		}
+		return
+	}
+
+	j.status.Running = true
+	j.pending = runs - 1
+	running.Add(1)
+	go func() {
+		defer running.Done()
+		for {
+			s.mu.Lock()
+			j.status.LastRun = s.clock.Now()
+			s.mu.Unlock()
+
+			err := runChild(ctx, j.run)
+
+			s.mu.Lock()
+			j.status.Runs++
+			j.status.LastError = err
+			if j.pending == 0 || ctx.Err() != nil {
+				j.status.Running = false
+				s.mu.Unlock()
+				return
+			}
+			j.pending--
+			s.mu.Unlock()
+		}
+	}()
+}
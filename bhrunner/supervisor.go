@@ -0,0 +1,349 @@
+package bhrunner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+var ErrRestartIntensity = errors.New("restart intensity exceeded")
+
+// RestartPolicy decides whether a child is started again after it returns.
+type RestartPolicy int
+
+const (
+	RestartNever RestartPolicy = iota
+	RestartOnFailure
+	RestartAlways
+)
+
+func (p RestartPolicy) String() string {
+	switch p {
+	case RestartNever:
+		return "never"
+	case RestartOnFailure:
+		return "on-failure"
+	case RestartAlways:
+		return "always"
+	default:
+		return fmt.Sprintf("RestartPolicy(%d)", int(p))
+	}
+}
+
+// PanicError is the failure of a child that panicked.
+type PanicError struct {
+	Value any
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+type ChildStatus int
+
+const (
+	ChildPending ChildStatus = iota
+	ChildRunning
+	// ChildBackoff waits to be restarted.
+	ChildBackoff
+	ChildStopped
+	ChildFailed
+)
+
+func (s ChildStatus) String() string {
+	switch s {
+	case ChildPending:
+		return "pending"
+	case ChildRunning:
+		return "running"
+	case ChildBackoff:
+		return "backoff"
+	case ChildStopped:
+		return "stopped"
+	case ChildFailed:
+		return "failed"
+	default:
+		return fmt.Sprintf("ChildStatus(%d)", int(s))
+	}
+}
+
+type ChildSpec struct {
+	Name    string
+	Run     func(ctx context.Context) error
+	Restart RestartPolicy
+}
+
+// ChildState is a snapshot of a supervised child.
+type ChildState struct {
+	Name      string
+	Status    ChildStatus
+	Restarts  int
+	StartedAt time.Time
+	LastError error
+}
+
+type SupervisorOptions struct {
+	// MinBackoff is the delay before the first restart, 100ms by default.
+	// It doubles with every failure in a row up to MaxBackoff, 30s by default.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Jitter randomizes each delay by up to this fraction, e.g. 0.2.
+	Jitter float64
+	// MaxRestarts restarts of all children within Window make the
+	// supervisor give up and stop every child. Zero means no limit, a zero
+	// Window means one minute.
+	MaxRestarts int
+	Window      time.Duration
+	// OnFailure is called for every error or panic of a child.
+	OnFailure func(name string, err error)
+}
+
+// Supervisor runs children on a GroupRunner and restarts them according to
+// their policy.
+type Supervisor struct {
+	opts   SupervisorOptions
+	runner *GroupRunner
+
+	mu       sync.Mutex
+	children []*child
+	restarts []time.Time
+	ctx      context.Context
+	cancel   context.CancelFunc
+	err      error
+	stopped  bool
+	done     chan struct{}
+}
+
+type child struct {
+	spec  ChildSpec
+	state ChildState
+}
+
+func NewSupervisor(opts SupervisorOptions) *Supervisor {
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = 100 * time.Millisecond
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = max(30*time.Second, opts.MinBackoff)
+	}
+	if opts.Window <= 0 {
+		opts.Window = time.Minute
+	}
+
+	return &Supervisor{
+		opts:   opts,
+		runner: NewGroupRunner(),
+		done:   make(chan struct{}),
+	}
+}
+
+// Add registers a child. Children added after Start are started right away.
+func (s *Supervisor) Add(spec ChildSpec) error {
+	if spec.Run == nil {
+		return errors.New("child has no run func")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, c := range s.children {
+		if c.spec.Name == spec.Name {
+			return fmt.Errorf("child %q already exists", spec.Name)
+		}
+	}
+	if s.err != nil {
+		return s.err
+	}
+	if s.stopped {
+		return errors.New("supervisor stopped")
+	}
+
+	c := &child{spec: spec, state: ChildState{Name: spec.Name}}
+	s.children = append(s.children, c)
+	if s.ctx != nil {
+		s.startLocked(c)
+	}
+	return nil
+}
+
+// Start starts every child. The supervisor stops when ctx is done.
+func (s *Supervisor) Start(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ctx != nil {
+		return errors.New("supervisor already started")
+	}
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	for _, c := range s.children {
+		s.startLocked(c)
+	}
+	return nil
+}
+
+// Stop cancels every child and waits for them to return. Children can no
+// longer be added afterwards.
+func (s *Supervisor) Stop(ctx context.Context) error {
+	s.mu.Lock()
+	s.stopped = true
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.mu.Unlock()
+
+	return s.runner.Stop(ctx)
+}
+
+// Done is closed when the supervisor gave up because of too many restarts.
+func (s *Supervisor) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns why the supervisor gave up.
+func (s *Supervisor) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Children returns the state of every child in the order they were added.
+func (s *Supervisor) Children() []ChildState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	states := make([]ChildState, len(s.children))
+	for i, c := range s.children {
+		states[i] = c.state
+	}
+	return states
+}
+
+func (s *Supervisor) startLocked(c *child) {
+	s.runner.GoNamed(s.ctx, c.spec.Name, nil, func(ctx context.Context) error {
+		s.supervise(ctx, c)
+		return nil
+	})
+}
+
+func (s *Supervisor) supervise(ctx context.Context, c *child) {
+	failures := 0
+	for {
+		s.setState(c, func(st *ChildState) {
+			st.Status = ChildRunning
+			st.StartedAt = time.Now()
+		})
+
+		t0 := time.Now()
+		err := runChild(ctx, c.spec.Run)
+		if err != nil && s.opts.OnFailure != nil && ctx.Err() == nil {
+			s.opts.OnFailure(c.spec.Name, err)
+		}
+
+		restart := ctx.Err() == nil && (c.spec.Restart == RestartAlways ||
+			(c.spec.Restart == RestartOnFailure && err != nil))
+		if !restart {
+			s.setState(c, func(st *ChildState) {
+				st.Status = ChildStopped
+				if err != nil && ctx.Err() == nil {
+					st.Status = ChildFailed
+				}
+				st.LastError = err
+			})
+			return
+		}
+
+		if !s.allowRestart() {
+			s.setState(c, func(st *ChildState) {
+				st.Status = ChildFailed
+				st.LastError = err
+			})
+			return
+		}
+
+		// a child that ran for a while starts over with the shortest delay
+		if time.Since(t0) >= s.opts.MaxBackoff {
+			failures = 0
+		}
+		delay := s.backoff(failures)
+		failures++
+
+		s.setState(c, func(st *ChildState) {
+			st.Status = ChildBackoff
+			st.LastError = err
+			st.Restarts++
+		})
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			s.setState(c, func(st *ChildState) {
+				st.Status = ChildStopped
+			})
+			return
+		}
+	}
+}
+
+// runChild turns a panic into a PanicError.
+func runChild(ctx context.Context, run func(context.Context) error) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = &PanicError{Value: v, Stack: debug.Stack()}
+		}
+	}()
+	return run(ctx)
+}
+
+func (s *Supervisor) setState(c *child, update func(*ChildState)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	update(&c.state)
+}
+
+// allowRestart counts a restart and gives up once the intensity is exceeded.
+func (s *Supervisor) allowRestart() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return false
+	}
+	if s.opts.MaxRestarts <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	kept := s.restarts[:0]
+	for _, t := range s.restarts {
+		if now.Sub(t) < s.opts.Window {
+			kept = append(kept, t)
+		}
+	}
+	s.restarts = append(kept, now)
+	if len(s.restarts) <= s.opts.MaxRestarts {
+		return true
+	}
+
+	s.err = fmt.Errorf("%w: %d restarts within %s", ErrRestartIntensity, len(s.restarts), s.opts.Window)
+	s.cancel()
+	close(s.done)
+	return false
+}
+
+func (s *Supervisor) backoff(failures int) time.Duration {
+	delay := s.opts.MaxBackoff
+	if failures < 32 {
+		delay = min(s.opts.MinBackoff<<failures, s.opts.MaxBackoff)
+	}
+	if s.opts.Jitter > 0 {
+		delay += time.Duration((rand.Float64()*2 - 1) * s.opts.Jitter * float64(delay))
+	}
+	return max(delay, 0)
+}
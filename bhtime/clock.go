@@ -0,0 +1,158 @@
+package bhtime
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time of code that should be testable with a FakeClock.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// SystemClock is the real time.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+type systemTimer struct {
+	t *time.Timer
+}
+
+func (st systemTimer) C() <-chan time.Time {
+	return st.t.C
+}
+
+func (st systemTimer) Stop() bool {
+	return st.t.Stop()
+}
+
+// FakeClock only moves when told to. Timers fire during Advance and Set.
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	timers  []*fakeTimer
+	changed chan struct{}
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{
+		now:     now,
+		changed: make(chan struct{}),
+	}
+}
+
+func (fc *FakeClock) Now() time.Time {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.now
+}
+
+func (fc *FakeClock) NewTimer(d time.Duration) Timer {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	t := &fakeTimer{clock: fc, at: fc.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.c <- fc.now
+		return t
+	}
+	fc.timers = append(fc.timers, t)
+	fc.notifyLocked()
+	return t
+}
+
+// Advance moves the clock forward by d.
+func (fc *FakeClock) Advance(d time.Duration) {
+	fc.Set(fc.Now().Add(d))
+}
+
+// Set moves the clock to now and fires the timers that are due, in order.
+func (fc *FakeClock) Set(now time.Time) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	fc.now = now
+	sort.SliceStable(fc.timers, func(i, j int) bool {
+		return fc.timers[i].at.Before(fc.timers[j].at)
+	})
+
+	kept := fc.timers[:0]
+	for _, t := range fc.timers {
+		if t.at.After(now) {
+			kept = append(kept, t)
+			continue
+		}
+		t.c <- t.at
+	}
+	clear(fc.timers[len(kept):])
+	fc.timers = kept
+	fc.notifyLocked()
+}
+
+// Timers returns the number of timers waiting to fire.
+func (fc *FakeClock) Timers() int {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return len(fc.timers)
+}
+
+// BlockUntil waits until at least n timers are waiting, so a test knows
+// the code under test went to sleep.
+func (fc *FakeClock) BlockUntil(n int) {
+	for {
+		fc.mu.Lock()
+		if len(fc.timers) >= n {
+			fc.mu.Unlock()
+			return
+		}
+		changed := fc.changed
+		fc.mu.Unlock()
+		<-changed
+	}
+}
+
+func (fc *FakeClock) notifyLocked() {
+	close(fc.changed)
+	fc.changed = make(chan struct{})
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	at    time.Time
+	c     chan time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	fc := t.clock
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	for i, other := range fc.timers {
+		if other == t {
+			fc.timers = append(fc.timers[:i], fc.timers[i+1:]...)
+			fc.notifyLocked()
+			return true
+		}
+	}
+	return false
+}
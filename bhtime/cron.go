@@ -0,0 +1,238 @@
+package bhtime
+
+import (
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule returns the first activation strictly after a given time, or
+// the zero time if there is none.
+type Schedule interface {
+	Next(after time.Time) time.Time
+}
+
+// Every is a fixed interval schedule.
+type Every time.Duration
+
+func (e Every) Next(after time.Time) time.Time {
+	if e <= 0 {
+		return time.Time{}
+	}
+	return after.Add(time.Duration(e))
+}
+
+// CronSchedule is a parsed five field cron expression: minute, hour, day of
+// month, month and day of week. As in Vixie cron a day matches if either
+// day field does, when both are restricted.
+type CronSchedule struct {
+	minute, hour, dom, month, dow uint64
+
+	domAny, dowAny bool
+	loc            *time.Location
+}
+
+type cronField struct {
+	min, max int
+	names    map[string]int
+}
+
+var (
+	cronMinute = cronField{0, 59, nil}
+	cronHour   = cronField{0, 23, nil}
+	cronDom    = cronField{1, 31, nil}
+	cronMonth  = cronField{1, 12, map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	cronDow = cronField{0, 7, map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// ParseCron parses a cron expression such as "*/15 9-17 * * mon-fri" or a
+// descriptor like "@daily". A leading "CRON_TZ=Zone" or "TZ=Zone" sets the
+// time zone, otherwise the zone of the time passed to Next is used.
+func ParseCron(expr string) (*CronSchedule, error) {
+	fields := strings.Fields(expr)
+	cs := &CronSchedule{}
+
+	if len(fields) > 0 && (strings.HasPrefix(fields[0], "CRON_TZ=") || strings.HasPrefix(fields[0], "TZ=")) {
+		_, zone, _ := strings.Cut(fields[0], "=")
+		loc, err := time.LoadLocation(zone)
+		if err != nil {
+			return nil, fmt.Errorf("cron %q: %w", expr, err)
+		}
+		cs.loc = loc
+		fields = fields[1:]
+	}
+
+	if len(fields) == 1 && strings.HasPrefix(fields[0], "@") {
+		desc, ok := cronDescriptors[strings.ToLower(fields[0])]
+		if !ok {
+			return nil, fmt.Errorf("cron %q: unknown descriptor", expr)
+		}
+		fields = strings.Fields(desc)
+	}
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron %q: want 5 fields, got %d", expr, len(fields))
+	}
+
+	var err error
+	parse := func(s string, f cronField) uint64 {
+		if err != nil {
+			return 0
+		}
+		var mask uint64
+		mask, err = parseCronField(s, f)
+		if err != nil {
+			err = fmt.Errorf("cron %q: %w", expr, err)
+		}
+		return mask
+	}
+	cs.minute = parse(fields[0], cronMinute)
+	cs.hour = parse(fields[1], cronHour)
+	cs.dom = parse(fields[2], cronDom)
+	cs.month = parse(fields[3], cronMonth)
+	cs.dow = parse(fields[4], cronDow)
+	if err != nil {
+		return nil, err
+	}
+
+	// 7 is another sunday
+	if cs.dow&(1<<7) != 0 {
+		cs.dow = cs.dow&^(1<<7) | 1
+	}
+	cs.domAny = fields[2] == "*" || fields[2] == "?"
+	cs.dowAny = fields[4] == "*" || fields[4] == "?"
+	return cs, nil
+}
+
+func parseCronField(s string, f cronField) (uint64, error) {
+	var mask uint64
+	for _, part := range strings.Split(s, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+
+		lo, hi := f.min, f.max
+		switch {
+		case rng == "*" || rng == "?":
+		default:
+			from, to, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = f.value(from); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if isRange {
+				if hi, err = f.value(to); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				// "5/10" means from 5 to the end
+				hi = f.max
+			}
+			if lo > hi {
+				return 0, fmt.Errorf("invalid range %q", rng)
+			}
+		}
+
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepStr)
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step %q", stepStr)
+			}
+		}
+
+		for v := lo; v <= hi; v += step {
+			mask |= 1 << v
+		}
+	}
+	return mask, nil
+}
+
+func (f cronField) value(s string) (int, error) {
+	if v, ok := f.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("invalid value %q, want %d-%d", s, f.min, f.max)
+	}
+	return v, nil
+}
+
+// In returns the schedule evaluated in loc.
+func (cs *CronSchedule) In(loc *time.Location) *CronSchedule {
+	c := *cs
+	c.loc = loc
+	return &c
+}
+
+// Location returns the zone of the schedule, nil meaning the zone of the
+// times passed to Next.
+func (cs *CronSchedule) Location() *time.Location {
+	return cs.loc
+}
+
+// cronSearchLimit bounds the search of Next, e.g. for "0 0 30 2 *".
+const cronSearchLimit = 5 * 366 * 24 * time.Hour
+
+// Next returns the first matching minute after t. The search steps in
+// elapsed time and matches the wall clock of the schedule's zone: times
+// skipped by a daylight saving change never match, and a repeated hour
+// matches twice.
+func (cs *CronSchedule) Next(after time.Time) time.Time {
+	loc := after.Location()
+	if cs.loc != nil {
+		loc = cs.loc
+	}
+
+	limit := after.Add(cronSearchLimit)
+	for t := after.Truncate(time.Minute).Add(time.Minute); t.Before(limit); {
+		wall := t.In(loc)
+		var skip int
+		switch {
+		case cs.month&(1<<uint(wall.Month())) == 0 || !cs.dayMatches(wall):
+			// to midnight, an hour early in case the day is short
+			skip = 24*60 - wall.Hour()*60 - wall.Minute()
+			if skip > 60 {
+				skip -= 60
+			}
+		case cs.hour&(1<<uint(wall.Hour())) == 0:
+			skip = 60 - wall.Minute()
+		case cs.minute&(1<<uint(wall.Minute())) == 0:
+			// straight to the next allowed minute of this hour
+			skip = 60 - wall.Minute()
+			if rest := cs.minute >> uint(wall.Minute()); rest != 0 {
+				skip = bits.TrailingZeros64(rest)
+			}
+		default:
+			return wall
+		}
+		t = t.Add(time.Duration(skip) * time.Minute)
+	}
+	return time.Time{}
+}
+
+func (cs *CronSchedule) dayMatches(t time.Time) bool {
+	dom := cs.dom&(1<<uint(t.Day())) != 0
+	dow := cs.dow&(1<<uint(t.Weekday())) != 0
+	if cs.domAny || cs.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
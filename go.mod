@@ -1,12 +1,12 @@
 module github.com/buhuang1002/bh-go-tools
 
-go 1.21
-
-toolchain go1.22.0
+go 1.23
 
 require (
 	github.com/Masterminds/sprig/v3 v3.2.3
 	github.com/emirpasic/gods/v2 v2.0.0-alpha
+	github.com/klauspost/compress v1.17.11
+	golang.org/x/net v0.33.0
 )
 
 require (
@@ -19,5 +19,5 @@ require (
 	github.com/mitchellh/reflectwalk v1.0.0 // indirect
 	github.com/shopspring/decimal v1.2.0 // indirect
 	github.com/spf13/cast v1.3.1 // indirect
-	golang.org/x/crypto v0.25.0 // indirect
+	golang.org/x/crypto v0.31.0 // indirect
 )